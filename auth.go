@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+)
+
+// APIKeyHeader carries the API key of the client
+const APIKeyHeader = "X-Api-Key"
+
+// Authentication schemes of a route
+const (
+	authNone   = "none"
+	authAPIKey = "apikey"
+	authMTLS   = "mtls"
+)
+
+// authFailures counts the rejected requests per scheme
+var authFailures = expvar.NewMap("auth_failures")
+
+// apiKeyName returns the name of the API key used by the request, if any
+func apiKeyName(r *http.Request) string {
+	name, _ := r.Context().Value(apiKeyNameKey).(string)
+	return name
+}
+
+// authenticate rejects the requests without the credentials required
+// by the scheme. keys maps client names to API keys.
+func authenticate(scheme string, keys map[string]string, next http.Handler) http.Handler {
+	switch scheme {
+	case authAPIKey:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, ok := matchAPIKey(keys, r.Header.Get(APIKeyHeader))
+			if !ok {
+				authFailures.Add(scheme, 1)
+				writeError(w, r, http.StatusUnauthorized, "invalid_api_key")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyNameKey, name)))
+		})
+	case authMTLS:
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				authFailures.Add(scheme, 1)
+				writeError(w, r, http.StatusUnauthorized, "client_cert_required")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	default:
+		return next
+	}
+}
+
+// matchAPIKey finds the client with the given key. All the keys are
+// compared, in constant time, so timing does not tell which one is close.
+func matchAPIKey(keys map[string]string, key string) (string, bool) {
+	var match string
+	for name, k := range keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 && key != "" {
+			match = name
+		}
+	}
+	return match, match != ""
+}
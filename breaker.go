@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned instead of calling NATS while the circuit
+// of a route is open. It is unavailable, so it can be queued.
+var errCircuitOpen = errors.New("Circuit open after repeated NATS failures")
+
+// breakerMetrics counts the times the circuit of each route opened, and
+// the calls rejected while open
+var breakerMetrics = expvar.NewMap("circuit_breakers")
+
+// breakerConfig opens the circuit of a route after consecutive NATS
+// failures of a retryable class, unavailable or timeout
+type breakerConfig struct {
+	Failures int      `json:"failures"`
+	Cooldown duration `json:"cooldown"`
+}
+
+// validate checks the breaker is either disabled or complete
+func (c *breakerConfig) validate() error {
+	if c != nil && (c.Failures <= 0 || c.Cooldown <= 0) {
+		return fmt.Errorf("needs positive failures and cooldown, got %d and %s", c.Failures, time.Duration(c.Cooldown))
+	}
+	return nil
+}
+
+// breaker fails the calls fast while the circuit is open. After the
+// cooldown, one call is let through: the circuit closes if it works,
+// and opens again if it fails.
+type breaker struct {
+	mu       sync.Mutex
+	name     string
+	cfg      *breakerConfig
+	failures int
+	until    time.Time
+	probing  bool
+}
+
+// breakers keeps the state across config reloads, by route
+var breakers = struct {
+	sync.Mutex
+	byName map[string]*breaker
+}{byName: make(map[string]*breaker)}
+
+// getBreaker returns the breaker of the route, with the given config,
+// nil to disable it
+func getBreaker(name string, cfg *breakerConfig) *breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.byName[name]
+	if !ok {
+		b = &breaker{name: name}
+		breakers.byName[name] = b
+	}
+	b.mu.Lock()
+	b.cfg = cfg
+	b.mu.Unlock()
+	return b
+}
+
+// allow is true if the call can go on, and otherwise tells when the
+// circuit may close
+func (b *breaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil || b.failures < b.cfg.Failures {
+		return true, 0
+	}
+	now := time.Now()
+	if now.Before(b.until) || b.probing {
+		breakerMetrics.Add(b.name+".rejected", 1)
+		return false, b.until.Sub(now)
+	}
+	b.probing = true
+	return true, 0
+}
+
+// record the result of a call. Only retryable errors count as
+// failures: the others mean NATS is there.
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg == nil {
+		return
+	}
+	wasOpen := b.failures >= b.cfg.Failures
+	b.probing = false
+	if err == nil || !classify(err).retryable() {
+		if wasOpen {
+			log.Printf("Circuit of route %s closed", b.name)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.cfg.Failures {
+		b.until = time.Now().Add(time.Duration(b.cfg.Cooldown))
+		if !wasOpen {
+			breakerMetrics.Add(b.name+".opened", 1)
+			log.Printf("ALERT circuit of route %s open for %s after %d failures: %v", b.name, time.Duration(b.cfg.Cooldown), b.failures, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestBreaker(t *testing.T) {
+	b := getBreaker("test", &breakerConfig{Failures: 2, Cooldown: duration(50 * time.Millisecond)})
+	steps := []struct {
+		err   error
+		allow bool
+	}{
+		{nats.ErrTimeout, true},
+		{nats.ErrBadSubject, true},
+		{nats.ErrNoResponders, true},
+		{nats.ErrTimeout, true},
+		{nil, false},
+	}
+	for i, step := range steps {
+		if ok, _ := b.allow(); ok != step.allow {
+			t.Fatalf("step %d: allow = %v, want %v", i, ok, step.allow)
+		}
+		if ok, _ := b.allow(); ok {
+			b.record(step.err)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("breaker not half open after the cooldown")
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("breaker let a second call through while half open")
+	}
+	b.record(nats.ErrConnectionClosed)
+	if ok, wait := b.allow(); ok || wait <= 0 {
+		t.Fatalf("breaker not open again after the probe failed: %v, %s", ok, wait)
+	}
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.record(nil)
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("breaker not closed after the probe worked")
+	}
+	if ok, _ := getBreaker("disabled", nil).allow(); !ok {
+		t.Fatal("disabled breaker rejected a call")
+	}
+}
+
+func TestWithRetryTimeouts(t *testing.T) {
+	tests := []struct {
+		err      error
+		timeouts bool
+		want     int
+	}{
+		{nats.ErrNoResponders, false, 3},
+		{nats.ErrTimeout, false, 1},
+		{nats.ErrTimeout, true, 3},
+		{nats.ErrBadSubject, true, 1},
+	}
+	for _, tt := range tests {
+		calls := 0
+		withRetry(context.Background(), 2, tt.timeouts, func() ([]byte, int, error) {
+			calls++
+			return nil, 0, tt.err
+		})
+		if calls != tt.want {
+			t.Errorf("withRetry(%v, timeouts %v) called %d times, want %d", tt.err, tt.timeouts, calls, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"expvar"
+	"hash/fnv"
+	"net/http"
+)
+
+// canaryMetrics counts requests and server errors for the stable and canary configs
+var canaryMetrics = expvar.NewMap("canary")
+
+// canaryRouter sends a percentage of the traffic to the canary router,
+// and the rest to the stable one.
+type canaryRouter struct {
+	stable  http.Handler
+	canary  http.Handler
+	percent int
+}
+
+func (c *canaryRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version, h := "stable", c.stable
+	if c.canary != nil && requestHash(r)%100 < uint32(c.percent) {
+		version, h = "canary", c.canary
+	}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	h.ServeHTTP(sw, r)
+	canaryMetrics.Add(version+".requests", 1)
+	if sw.status >= 500 {
+		canaryMetrics.Add(version+".errors", 1)
+	}
+}
+
+// requestHash hashes the request ID if the client sent one, or the client
+// address otherwise, so retries of the same request get the same config.
+func requestHash(r *http.Request) uint32 {
+	key := r.Header.Get(RequestIDHeader)
+	if key == "" {
+		key = clientIP(r)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// statusWriter records the status code sent by the handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
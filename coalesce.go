@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// CoalesceHeader opts a request in to coalescing with identical ones
+const CoalesceHeader = "X-Coalesce"
+
+var (
+	requestGroup singleflight.Group
+	// coalescedRequests counts the requests answered with a shared reply
+	coalescedRequests = expvar.NewInt("coalesced_requests")
+)
+
+// wantsCoalescing is true if the client opted in to coalescing
+func wantsCoalescing(r *http.Request) bool {
+	ok, _ := strconv.ParseBool(r.Header.Get(CoalesceHeader))
+	return ok
+}
+
+// coalescedResult is the outcome of a shared call
+type coalescedResult struct {
+	data   []byte
+	status int
+}
+
+// coalesce makes a single call for all the concurrent requests with the
+// same subject and payload, and fans the reply out to all of them. The
+// shared call has its own deadline, so it is not cancelled if the caller
+// that started it goes away; each caller only waits within its own ctx.
+// The latency budget forwarded is the one of the first caller.
+func coalesce(ctx context.Context, subject string, data []byte, deadline time.Duration, call func(ctx context.Context) ([]byte, int, error)) ([]byte, int, error) {
+	sum := sha256.Sum256(data)
+	key := subject + " " + hex.EncodeToString(sum[:])
+	ch := requestGroup.DoChan(key, func() (interface{}, error) {
+		shared, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+		data, status, err := call(withBudget(shared, ctx))
+		return coalescedResult{data: data, status: status}, err
+	})
+	select {
+	case <-ctx.Done():
+		return nil, natsStatus(ctx.Err()), ctx.Err()
+	case res := <-ch:
+		if res.Shared {
+			coalescedRequests.Add(1)
+		}
+		result := res.Val.(coalescedResult)
+		return result.data, result.status, res.Err
+	}
+}
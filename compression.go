@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+// EncodingHeader tells the compression of a NATS message payload
+const EncodingHeader = "Content-Encoding"
+
+// DefaultCompressBytes is the smallest payload compressed by default
+const DefaultCompressBytes = 1024
+
+// MaxDecompressedSize is the largest payload a compressed message can
+// expand to
+const MaxDecompressedSize = 8 << 20
+
+// compressMetrics counts the bytes before and after compression, and
+// the messages decompressed
+var compressMetrics = expvar.NewMap("compression")
+
+// compressConfig compresses the payloads of a JetStream publish route
+type compressConfig struct {
+	// Encoding is "gzip" (default) or "zstd"
+	Encoding string `json:"encoding,omitempty"`
+	// MinBytes is the smallest payload compressed, 1024 by default
+	MinBytes int `json:"min_bytes,omitempty"`
+}
+
+// validate checks the encoding is known
+func (c *compressConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	switch c.Encoding {
+	case "", "gzip", "zstd":
+	default:
+		return fmt.Errorf("Unknown encoding %q", c.Encoding)
+	}
+	if c.MinBytes < 0 {
+		return errors.New("Negative min_bytes")
+	}
+	return nil
+}
+
+// zstd encoders and decoders are safe for concurrent EncodeAll and
+// DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxDecompressedSize))
+)
+
+// compressMsg compresses the payload of the message, if it is large
+// enough, and marks the encoding in its headers
+func compressMsg(msg *nats.Msg, c *compressConfig) error {
+	if c == nil {
+		return nil
+	}
+	min := c.MinBytes
+	if min == 0 {
+		min = DefaultCompressBytes
+	}
+	if len(msg.Data) < min {
+		return nil
+	}
+	encoding := c.Encoding
+	if encoding == "" {
+		encoding = "gzip"
+	}
+	var data []byte
+	switch encoding {
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(msg.Data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	case "zstd":
+		data = zstdEncoder.EncodeAll(msg.Data, nil)
+	}
+	compressMetrics.Add("bytes_in", int64(len(msg.Data)))
+	compressMetrics.Add("bytes_out", int64(len(data)))
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(EncodingHeader, encoding)
+	msg.Data = data
+	return nil
+}
+
+// payload returns the payload of the message, decompressed if it has
+// an encoding header
+func payload(msg *nats.Msg) ([]byte, error) {
+	encoding := ""
+	if msg.Header != nil {
+		encoding = msg.Header.Get(EncodingHeader)
+	}
+	var data []byte
+	var err error
+	switch encoding {
+	case "":
+		return msg.Data, nil
+	case "gzip":
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(msg.Data)); err == nil {
+			data, err = ioutil.ReadAll(io.LimitReader(zr, MaxDecompressedSize+1))
+		}
+		if err == nil && len(data) > MaxDecompressedSize {
+			err = fmt.Errorf("Decompressed message larger than %d bytes", MaxDecompressedSize)
+		}
+	case "zstd":
+		data, err = zstdDecoder.DecodeAll(msg.Data, nil)
+	default:
+		err = fmt.Errorf("Unknown encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error decompressing message from %s: %v", msg.Subject, err)
+	}
+	compressMetrics.Add("decompressed", 1)
+	return data, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestCompression(t *testing.T) {
+	large := bytes.Repeat([]byte(`{"reading": 21.5}`), 200)
+	tests := []struct {
+		cfg      *compressConfig
+		data     []byte
+		encoding string
+	}{
+		{nil, large, ""},
+		{&compressConfig{}, []byte(`{"small": true}`), ""},
+		{&compressConfig{}, large, "gzip"},
+		{&compressConfig{Encoding: "zstd"}, large, "zstd"},
+		{&compressConfig{MinBytes: 4}, []byte(`{"small": true}`), "gzip"},
+	}
+	for _, tt := range tests {
+		msg := &nats.Msg{Subject: "s", Data: tt.data}
+		if err := compressMsg(msg, tt.cfg); err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Header.Get(EncodingHeader); got != tt.encoding {
+			t.Errorf("compressMsg(%v) encoding = %q, want %q", tt.cfg, got, tt.encoding)
+		}
+		if tt.encoding != "" && len(msg.Data) >= len(tt.data) && len(tt.data) > 100 {
+			t.Errorf("compressMsg(%v) did not reduce %d bytes", tt.cfg, len(tt.data))
+		}
+		data, err := payload(msg)
+		if err != nil || !bytes.Equal(data, tt.data) {
+			t.Errorf("payload after compressMsg(%v) = %d bytes, %v", tt.cfg, len(data), err)
+		}
+	}
+	msg := &nats.Msg{Subject: "s", Data: []byte("not gzip"), Header: nats.Header{EncodingHeader: []string{"gzip"}}}
+	if _, err := payload(msg); err == nil {
+		t.Errorf("payload of an invalid gzip message succeeded")
+	}
+	msg.Header.Set(EncodingHeader, "br")
+	if _, err := payload(msg); err == nil {
+		t.Errorf("payload with an unknown encoding succeeded")
+	}
+	if err := (&compressConfig{Encoding: "br"}).validate(); err == nil {
+		t.Errorf("validate accepted an unknown encoding")
+	}
+}
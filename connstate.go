@@ -0,0 +1,174 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// connState is the lifecycle state of the NATS connection
+type connState int
+
+const (
+	stateConnecting connState = iota
+	stateConnected
+	stateReconnecting
+	stateDraining
+	stateClosed
+)
+
+var stateNames = map[connState]string{
+	stateConnecting:   "connecting",
+	stateConnected:    "connected",
+	stateReconnecting: "reconnecting",
+	stateDraining:     "draining",
+	stateClosed:       "closed",
+}
+
+func (s connState) String() string {
+	return stateNames[s]
+}
+
+// Behaviors of the routes for each connection state
+const (
+	// behaviorBuffer accepts publishes and requests, the client buffers
+	// them until the connection is back or the deadline expires
+	behaviorBuffer = "buffer"
+	// behaviorReject answers 503 to every request
+	behaviorReject = "reject"
+	// behaviorDegrade accepts publishes, but answers 503 to requests
+	behaviorDegrade = "degrade"
+)
+
+// defaultBehaviors apply to the states not configured in the settings
+var defaultBehaviors = map[string]string{
+	stateConnecting.String():   behaviorReject,
+	stateReconnecting.String(): behaviorBuffer,
+	stateDraining.String():     behaviorReject,
+}
+
+// connTracker follows the connection through its lifecycle
+type connTracker struct {
+	mu          sync.Mutex
+	state       connState
+	since       time.Time
+	transitions map[string]int64
+	closed      chan struct{}
+}
+
+// connection is the state of the gateway's NATS connection
+var connection = &connTracker{
+	since:       time.Now(),
+	transitions: make(map[string]int64),
+	closed:      make(chan struct{}),
+}
+
+func init() {
+	expvar.Publish("nats_state", expvar.Func(func() interface{} { return connection.status() }))
+}
+
+// connStatus is the state of the connection, for metrics and the admin API
+type connStatus struct {
+	State       string           `json:"state"`
+	Since       time.Time        `json:"since"`
+	Transitions map[string]int64 `json:"transitions"`
+}
+
+// set moves the connection to a new state
+func (t *connTracker) set(s connState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == s {
+		return
+	}
+	if t.state == stateClosed {
+		// Closed is final
+		return
+	}
+	log.Printf("NATS connection %s -> %s", t.state, s)
+	t.transitions[fmt.Sprintf("%s->%s", t.state, s)]++
+	t.state = s
+	t.since = time.Now()
+	if s == stateClosed {
+		close(t.closed)
+	}
+}
+
+// current returns the current state
+func (t *connTracker) current() connState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state
+}
+
+// status returns a snapshot of the connection state
+func (t *connTracker) status() connStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	transitions := make(map[string]int64, len(t.transitions))
+	for k, v := range t.transitions {
+		transitions[k] = v
+	}
+	return connStatus{State: t.state.String(), Since: t.since, Transitions: transitions}
+}
+
+// options hooks the tracker to the connection events
+func (t *connTracker) options() []nats.Option {
+	return []nats.Option{
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("NATS disconnected: %+v", err)
+			}
+			if !nc.IsClosed() && !nc.IsDraining() {
+				t.set(stateReconnecting)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			t.set(stateConnected)
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			t.set(stateClosed)
+		}),
+	}
+}
+
+// stateGate applies the configured behavior for the connection state
+// before letting requests through to a route.
+func stateGate(behaviors map[string]string, action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := connection.current()
+		behavior := behaviorBuffer
+		switch state {
+		case stateConnected:
+		case stateClosed:
+			behavior = behaviorReject
+		default:
+			if b, ok := behaviors[state.String()]; ok {
+				behavior = b
+			} else {
+				behavior = defaultBehaviors[state.String()]
+			}
+		}
+		if behavior == behaviorReject || (behavior == behaviorDegrade && action == "request") {
+			writeError(w, r, http.StatusServiceUnavailable, "connection_state", state)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connectionStatus reports the state of the NATS connection in the admin API
+func (gw *gateway) connectionStatus(w http.ResponseWriter, r *http.Request) {
+	stats := gw.nc.Stats()
+	writeJSON(w, http.StatusOK, struct {
+		connStatus
+		URL       string          `json:"url"`
+		Stats     nats.Statistics `json:"stats"`
+		JetStream jsInfo          `json:"jetstream"`
+	}{connection.status(), gw.nc.ConnectedUrlRedacted(), stats, gw.jetStreamInfo(r.Context())})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+)
+
+// Defaults of the schema drift detection
+const (
+	DefaultDriftSample = 10
+	DefaultDriftLearn  = 100
+	// MaxDriftSubjects bounds the profiles kept, for wildcard patterns
+	// matching many subjects
+	MaxDriftSubjects = 1000
+)
+
+// driftConfig selects the subjects whose payloads are profiled
+type driftConfig struct {
+	// Subjects are the patterns to profile, may include wildcards
+	Subjects []string `json:"subjects"`
+	// SamplePercent of the payloads are checked
+	SamplePercent int `json:"sample_percent,omitempty"`
+	// Learn is the number of samples that establish the shape
+	Learn int `json:"learn,omitempty"`
+	// OpsSubject receives an event for every drifted payload
+	OpsSubject string `json:"ops_subject,omitempty"`
+}
+
+// validate checks the config makes sense
+func (c driftConfig) validate() error {
+	if c.SamplePercent < 0 || c.SamplePercent > 100 {
+		return fmt.Errorf("Invalid schema_drift sample_percent %d", c.SamplePercent)
+	}
+	if c.Learn < 0 {
+		return fmt.Errorf("Invalid schema_drift learn %d", c.Learn)
+	}
+	if c.OpsSubject != "" && !validSubject(c.OpsSubject) {
+		return fmt.Errorf("Invalid schema_drift ops_subject %q", c.OpsSubject)
+	}
+	return nil
+}
+
+// driftCounts counts the drifted payloads by subject
+var driftCounts = expvar.NewMap("schema_drift")
+
+// shapeProfile is the structure learned for a subject: the JSON paths
+// seen, in how many samples, and with which types
+type shapeProfile struct {
+	Samples int                        `json:"samples"`
+	Paths   map[string]int             `json:"paths"`
+	Types   map[string]map[string]bool `json:"types"`
+}
+
+// driftEvent is published to the ops subject when a payload drifts
+type driftEvent struct {
+	Subject string    `json:"subject"`
+	Time    time.Time `json:"time"`
+	Changes []string  `json:"changes"`
+}
+
+// driftDetector keeps the profiles of the subjects
+type driftDetector struct {
+	mu       sync.Mutex
+	nc       *nats.Conn
+	cfg      driftConfig
+	profiles map[string]*shapeProfile
+}
+
+var drift = &driftDetector{profiles: make(map[string]*shapeProfile)}
+
+// update applies the config. Profiles are kept.
+func (d *driftDetector) update(nc *nats.Conn, cfg driftConfig) {
+	if cfg.SamplePercent == 0 {
+		cfg.SamplePercent = DefaultDriftSample
+	}
+	if cfg.Learn == 0 {
+		cfg.Learn = DefaultDriftLearn
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nc, d.cfg = nc, cfg
+}
+
+// observe checks a sample of the payloads sent to the subject against
+// its profile, or learns from them until the profile is established
+func (d *driftDetector) observe(subject string, data []byte) {
+	d.mu.Lock()
+	cfg := d.cfg
+	d.mu.Unlock()
+	if !matchesAny(cfg.Subjects, subject) || rand.Intn(100) >= cfg.SamplePercent {
+		return
+	}
+	shape := make(map[string]string)
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		shape["$"] = "invalid"
+	} else {
+		shapeOf(body, "$", shape)
+	}
+	d.mu.Lock()
+	p, ok := d.profiles[subject]
+	if !ok {
+		if len(d.profiles) >= MaxDriftSubjects {
+			d.mu.Unlock()
+			return
+		}
+		p = &shapeProfile{Paths: make(map[string]int), Types: make(map[string]map[string]bool)}
+		d.profiles[subject] = p
+	}
+	if p.Samples < cfg.Learn {
+		p.learn(shape)
+		if p.Samples == cfg.Learn {
+			log.Printf("Learned the payload shape of %s: %d fields", subject, len(p.Paths))
+		}
+		d.mu.Unlock()
+		return
+	}
+	changes := p.compare(shape)
+	nc := d.nc
+	d.mu.Unlock()
+	if len(changes) == 0 {
+		return
+	}
+	driftCounts.Add(subject, 1)
+	log.Printf("ALERT payload of %s drifted: %v", subject, changes)
+	if cfg.OpsSubject != "" && nc != nil {
+		event, _ := json.Marshal(driftEvent{Subject: subject, Time: time.Now(), Changes: changes})
+		if err := nc.Publish(cfg.OpsSubject, event); err != nil {
+			log.Print("Error publishing drift event: ", err)
+		}
+	}
+}
+
+// learn adds a sample to the profile
+func (p *shapeProfile) learn(shape map[string]string) {
+	p.Samples++
+	for path, t := range shape {
+		p.Paths[path]++
+		if p.Types[path] == nil {
+			p.Types[path] = make(map[string]bool)
+		}
+		p.Types[path][t] = true
+	}
+}
+
+// compare describes how the shape differs from the profile: new fields,
+// fields with another type, and missing fields that were always present
+func (p *shapeProfile) compare(shape map[string]string) []string {
+	var changes []string
+	for path, t := range shape {
+		if _, ok := p.Paths[path]; !ok {
+			changes = append(changes, fmt.Sprintf("new field %s (%s)", path, t))
+		} else if !p.Types[path][t] {
+			changes = append(changes, fmt.Sprintf("field %s is %s, was %s", path, t, typeList(p.Types[path])))
+		}
+	}
+	for path, n := range p.Paths {
+		if _, ok := shape[path]; !ok && n == p.Samples {
+			changes = append(changes, fmt.Sprintf("missing field %s", path))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// shapeOf records the JSON type of every path in v. Array items share
+// the path of the array, with a [] suffix.
+func shapeOf(v interface{}, path string, shape map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		shape[path] = "object"
+		for k, child := range v {
+			shapeOf(child, path+"."+k, shape)
+		}
+	case []interface{}:
+		shape[path] = "array"
+		for _, item := range v {
+			shapeOf(item, path+"[]", shape)
+		}
+	case string:
+		shape[path] = "string"
+	case float64:
+		shape[path] = "number"
+	case bool:
+		shape[path] = "boolean"
+	default:
+		shape[path] = "null"
+	}
+}
+
+func typeList(types map[string]bool) string {
+	names := make([]string, 0, len(types))
+	for t := range types {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	return fmt.Sprint(names)
+}
+
+// matchesAny is true if the subject matches any of the patterns
+func matchesAny(patterns []string, subject string) bool {
+	for _, p := range patterns {
+		if subjectMatches(p, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemas lists the learned profiles in the admin API
+func (gw *gateway) schemas(w http.ResponseWriter, r *http.Request) {
+	drift.mu.Lock()
+	defer drift.mu.Unlock()
+	writeJSON(w, http.StatusOK, drift.profiles)
+}
+
+// forgetSchema drops the profile of a subject, to learn it again after
+// an intended change of the payloads
+func (gw *gateway) forgetSchema(w http.ResponseWriter, r *http.Request) {
+	subject := mux.Vars(r)["subject"]
+	drift.mu.Lock()
+	_, ok := drift.profiles[subject]
+	delete(drift.profiles, subject)
+	drift.mu.Unlock()
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "unknown_schema", subject)
+		return
+	}
+	log.Printf("AUDIT schema drift: forgot the payload shape of %s", subject)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestShapeOf(t *testing.T) {
+	tests := []struct {
+		doc  string
+		want map[string]string
+	}{
+		{`"a"`, map[string]string{"$": "string"}},
+		{`null`, map[string]string{"$": "null"}},
+		{`{"id": 1, "ok": true, "tags": ["a", "b"]}`, map[string]string{
+			"$": "object", "$.id": "number", "$.ok": "boolean", "$.tags": "array", "$.tags[]": "string",
+		}},
+		{`{"items": [{"n": 1}, {"n": "x"}]}`, map[string]string{
+			"$": "object", "$.items": "array", "$.items[]": "object", "$.items[].n": "string",
+		}},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tt.doc), &v); err != nil {
+			t.Fatal(err)
+		}
+		shape := make(map[string]string)
+		shapeOf(v, "$", shape)
+		if !reflect.DeepEqual(shape, tt.want) {
+			t.Errorf("shapeOf(%s) = %v, want %v", tt.doc, shape, tt.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	p := &shapeProfile{Paths: make(map[string]int), Types: make(map[string]map[string]bool)}
+	p.learn(map[string]string{"$": "object", "$.id": "number", "$.note": "string"})
+	p.learn(map[string]string{"$": "object", "$.id": "number"})
+	tests := []struct {
+		shape map[string]string
+		want  []string
+	}{
+		{map[string]string{"$": "object", "$.id": "number"}, nil},
+		{map[string]string{"$": "object", "$.id": "number", "$.note": "string"}, nil},
+		{map[string]string{"$": "object", "$.id": "string"}, []string{"field $.id is string, was [number]"}},
+		{map[string]string{"$": "object", "$.id": "number", "$.new": "boolean"}, []string{"new field $.new (boolean)"}},
+		{map[string]string{"$": "object"}, []string{"missing field $.id"}},
+	}
+	for _, tt := range tests {
+		if got := p.compare(tt.shape); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("compare(%v) = %q, want %q", tt.shape, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// RetryBackoff is the wait between retries of a NATS operation
+const RetryBackoff = 100 * time.Millisecond
+
+// errorClass groups NATS errors by how the gateway should react to them
+type errorClass int
+
+const (
+	// classInternal errors are unexpected, and not worth retrying
+	classInternal errorClass = iota
+	// classUnavailable errors come from the connection state, and may
+	// succeed once the client reconnects
+	classUnavailable
+	// classTimeout errors ran out of time waiting for the server or a reply
+	classTimeout
+	// classDenied errors are authorization or permission violations
+	classDenied
+	// classInvalid errors are caused by the subject or payload sent
+	classInvalid
+)
+
+var classNames = map[errorClass]string{
+	classInternal:    "internal",
+	classUnavailable: "unavailable",
+	classTimeout:     "timeout",
+	classDenied:      "denied",
+	classInvalid:     "invalid",
+}
+
+func (c errorClass) String() string {
+	return classNames[c]
+}
+
+// natsErrors counts NATS errors by class
+var natsErrors = expvar.NewMap("nats_errors")
+
+// classify tells the class of a NATS error
+func classify(err error) errorClass {
+	for class, errs := range classErrors {
+		for _, e := range errs {
+			if errors.Is(err, e) {
+				return class
+			}
+		}
+	}
+	// Permission violations are reported asynchronously, with the subject appended
+	if strings.Contains(err.Error(), nats.PERMISSIONS_ERR) || strings.Contains(err.Error(), nats.AUTHORIZATION_ERR) {
+		return classDenied
+	}
+	return classInternal
+}
+
+// classErrors lists the known errors of each class
+var classErrors = map[errorClass][]error{
+	classUnavailable: {
+		nats.ErrConnectionClosed, nats.ErrConnectionDraining, nats.ErrConnectionReconnecting,
+		nats.ErrNoServers, nats.ErrStaleConnection, nats.ErrReconnectBufExceeded,
+		nats.ErrInvalidConnection, nats.ErrNoResponders, jetstream.ErrNoStreamResponse,
+		errCircuitOpen,
+	},
+	classTimeout: {nats.ErrTimeout, context.DeadlineExceeded},
+	classDenied:  {nats.ErrAuthorization, nats.ErrPermissionViolation},
+	classInvalid: {nats.ErrBadSubject, nats.ErrMaxPayload, nats.ErrInvalidMsg, nats.ErrInvalidArg},
+}
+
+// natsCode is the error code of a NATS error in responses
+func natsCode(err error) string {
+	return "nats_" + classify(err).String()
+}
+
+// retryable is true if the operation may succeed if attempted again
+func (c errorClass) retryable() bool {
+	return c == classUnavailable || c == classTimeout
+}
+
+// natsStatus maps NATS errors to HTTP status codes
+func natsStatus(err error) int {
+	switch classify(err) {
+	case classUnavailable:
+		return http.StatusServiceUnavailable
+	case classTimeout:
+		return http.StatusGatewayTimeout
+	case classDenied:
+		return http.StatusForbidden
+	case classInvalid:
+		if errors.Is(err, nats.ErrMaxPayload) {
+			return http.StatusRequestEntityTooLarge
+		}
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// withRetry runs f, and attempts it again up to retries times while it
+// fails with a retryable error and there is time left in the context.
+// Timeouts are only retried if timeouts is true, since the operation
+// may have been done anyway.
+func withRetry(ctx context.Context, retries int, timeouts bool, f func() ([]byte, int, error)) (data []byte, status int, err error) {
+	for attempt := 0; ; attempt++ {
+		data, status, err = f()
+		if err == nil {
+			return data, status, nil
+		}
+		class := classify(err)
+		natsErrors.Add(class.String(), 1)
+		if !class.retryable() || (class == classTimeout && !timeouts) || attempt >= retries {
+			return data, status, err
+		}
+		select {
+		case <-ctx.Done():
+			return data, status, err
+		case <-time.After(RetryBackoff << uint(attempt)):
+		}
+	}
+}
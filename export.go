@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// MaxImportSize is the maximum size of an imported config document
+const MaxImportSize = 1 << 20
+
+// exportConfig sends the settings in use, as a config file document.
+// The NATS password and the API keys are redacted, unless the request
+// asks for them with include_secrets=true, to restore the document
+// into a fresh instance.
+func (gw *gateway) exportConfig(w http.ResponseWriter, r *http.Request) {
+	s := gw.current()
+	if secrets, _ := strconv.ParseBool(r.URL.Query().Get("include_secrets")); secrets {
+		log.Printf("AUDIT config exported with secrets from %s", r.RemoteAddr)
+	} else {
+		s = s.redacted()
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="nats-gw.json"`)
+	writeJSON(w, http.StatusOK, s)
+}
+
+// startupSections are the sections of the config file that belong to
+// each instance and only apply on startup, so they are not imported
+var startupSections = []string{"nats", "store", "journal", "responder"}
+
+// importConfig applies a config document exported from another gateway.
+// The startup sections are kept, since they belong to this instance.
+// Redacted API keys keep their value in this instance, and are rejected
+// if it does not have them. If the gateway has a config file, the
+// imported document is saved there, with the startup sections of the
+// file, so it survives reloads and restarts.
+func (gw *gateway) importConfig(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxImportSize))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_config", err)
+		return
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_config", err)
+		return
+	}
+	current := gw.current()
+	for _, section := range startupSections {
+		delete(doc, section)
+	}
+	if err := restoreKeys(doc, current.APIKeys); err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_config", err)
+		return
+	}
+	// The settings in use are resolved with the startup sections of
+	// this instance, and the file keeps its own
+	resolved := make(map[string]interface{}, len(doc)+len(startupSections))
+	for name, value := range doc {
+		resolved[name] = value
+	}
+	resolved["nats"], resolved["store"] = current.NATS, current.Store
+	resolved["journal"], resolved["responder"] = current.Journal, current.Responder
+	if data, err = json.Marshal(resolved); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+		return
+	}
+	s, err := parseSettings(gw.cfg, data)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "invalid_config", err)
+		return
+	}
+	if gw.cfg.File != "" {
+		if err := saveImport(gw.cfg.File, doc); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+			return
+		}
+	}
+	gw.apply(s, "import")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restoreKeys replaces the redacted API keys of the document with their
+// value in this instance
+func restoreKeys(doc map[string]json.RawMessage, current map[string]string) error {
+	raw, ok := doc["api_keys"]
+	if !ok {
+		return nil
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return err
+	}
+	for name, key := range keys {
+		if key != redactedValue {
+			continue
+		}
+		prev, ok := current[name]
+		if !ok {
+			return fmt.Errorf("API key %s is redacted, and not set in this gateway", name)
+		}
+		keys[name] = prev
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	doc["api_keys"] = data
+	return nil
+}
+
+// saveImport writes the imported document to the config file, with the
+// startup sections the file had, as they were written
+func saveImport(path string, doc map[string]json.RawMessage) error {
+	old, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(old) > 0 {
+		var file map[string]json.RawMessage
+		if err := json.Unmarshal(old, &file); err != nil {
+			return err
+		}
+		for _, section := range startupSections {
+			if value, ok := file[section]; ok {
+				doc[section] = value
+			}
+		}
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// writeFile replaces the file atomically, keeping its permissions
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if info, err := os.Stat(path); err == nil {
+		if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// MaxConfigChanges is the number of config changes kept for the admin API
+const MaxConfigChanges = 20
+
+// changesPrefix is the prefix of the config change keys in the store
+const changesPrefix = "changes."
+
+// accessLog is where the HTTP requests are logged
+var accessLog io.Writer = os.Stdout
+
+// configChange records a change in the gateway settings
+type configChange struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Changes []string  `json:"changes"`
+}
+
+// gateway routes HTTP requests to NATS, according to the current settings
+type gateway struct {
+	nc      *nats.Conn
+	cfg     config
+	router  atomic.Value // *canaryRouter
+	signKey ed25519.PrivateKey
+	js      jetstream.JetStream
+	store   store
+	queue   *retryQueue
+	journal *journal
+
+	mu       sync.Mutex
+	settings settings
+	stable   http.Handler
+}
+
+// newGateway creates a gateway with the settings from the config file
+func newGateway(nc *nats.Conn, cfg config, s settings) (*gateway, error) {
+	var err error
+	gw := &gateway{nc: nc, cfg: cfg}
+	if gw.js, err = newJetStream(nc, s.NATS); err != nil {
+		return nil, err
+	}
+	if cfg.SignKey != "" {
+		if gw.signKey, err = loadSigningKey(cfg.SignKey); err != nil {
+			return nil, err
+		}
+		pub := gw.signKey.Public().(ed25519.PublicKey)
+		log.Printf("Signing replies with public key %s", base64.StdEncoding.EncodeToString(pub))
+	}
+	if gw.store, err = openStore(s.Store, gw.js); err != nil {
+		return nil, err
+	}
+	gw.queue = &retryQueue{nc: nc, store: gw.store}
+	if cfg.QueueKeys != "" {
+		if gw.queue.keys, err = loadQueueKeys(cfg.QueueKeys); err != nil {
+			return nil, err
+		}
+	}
+	if s.Journal.Bucket != "" {
+		if gw.journal, err = openJournal(gw.js, s.Journal); err != nil {
+			return nil, err
+		}
+	}
+	gw.apply(s, "startup")
+	return gw, nil
+}
+
+// ServeHTTP dispatches the request to the current router
+func (gw *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gw.router.Load().(*canaryRouter).ServeHTTP(w, r)
+}
+
+// current returns the settings in use
+func (gw *gateway) current() settings {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	return gw.settings
+}
+
+// limits returns the resource limits in use
+func (gw *gateway) limits() resourceLimits {
+	return gw.current().Limits
+}
+
+// apply replaces the settings, and records the changes. If the settings
+// have a canary percentage, the new routes only get that share of the
+// traffic, and the rest keeps going to the last fully applied ones.
+func (gw *gateway) apply(s settings, source string) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	change := configChange{Time: time.Now(), Source: source, Changes: s.diff(gw.settings)}
+	if source != "startup" && s.NATS != gw.settings.NATS {
+		log.Print("WARNING: NATS connection settings changed, restart the gateway to apply them")
+	}
+	if source != "startup" && s.Store != gw.settings.Store {
+		log.Print("WARNING: store settings changed, restart the gateway to apply them")
+	}
+	if source != "startup" && s.Journal != gw.settings.Journal {
+		log.Print("WARNING: journal settings changed, restart the gateway to apply them")
+	}
+	router := gw.routes(s)
+	if s.Canary > 0 && s.Canary < 100 && gw.stable != nil {
+		change.Source = fmt.Sprintf("%s (canary %d%%)", source, s.Canary)
+		gw.router.Store(&canaryRouter{stable: gw.stable, canary: router, percent: s.Canary})
+	} else {
+		gw.stable = router
+		gw.router.Store(&canaryRouter{stable: router})
+	}
+	gw.settings = s
+	activeTaps.update(gw.nc, s.Taps)
+	drift.update(gw.nc, s.SchemaDrift)
+	readOnly.update(s.ReadOnly)
+	if catalog, err := mergeMessages(s.Messages); err == nil {
+		messages.Store(catalog)
+	}
+	for _, line := range change.Changes {
+		log.Printf("AUDIT config %s: %s", change.Source, line)
+	}
+	if source == "startup" {
+		// On upgrades, the bolt store is only opened once the previous
+		// process stops serving, after this one is ready
+		go gw.logChange(change)
+	} else {
+		gw.logChange(change)
+	}
+}
+
+// logChange records the change, and logs if it fails
+func (gw *gateway) logChange(change configChange) {
+	if err := gw.recordChange(change); err != nil {
+		log.Print("Error recording config change: ", err)
+	}
+}
+
+// recordChange saves the change in the store, and drops the oldest ones
+// beyond MaxConfigChanges. Keys sort by time.
+func (gw *gateway) recordChange(change configChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%020d", changesPrefix, change.Time.UnixNano())
+	if err := gw.store.Put(key, data); err != nil {
+		return err
+	}
+	keys, err := gw.store.Keys(changesPrefix)
+	if err != nil {
+		return err
+	}
+	for len(keys) > MaxConfigChanges {
+		if err := gw.store.Delete(keys[0]); err != nil && err != errNotFound {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// reload reads the config file again and applies it
+func (gw *gateway) reload() error {
+	s, err := loadSettings(gw.cfg)
+	if err != nil {
+		return err
+	}
+	gw.apply(s, "reload")
+	return nil
+}
+
+// reloadOnSignal reloads the config file on every SIGHUP
+func (gw *gateway) reloadOnSignal() {
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, syscall.SIGHUP)
+	for range sigChannel {
+		log.Print("Reloading config")
+		if err := gw.reload(); err != nil {
+			log.Print("Error reloading config, keeping current one: ", err)
+		}
+	}
+}
+
+// routes builds the router for the given settings
+func (gw *gateway) routes(s settings) http.Handler {
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/ready").HandlerFunc(readyHandler)
+	r.Methods("GET").Path("/sessions").Handler(
+		handlers.LoggingHandler(accessLog, recoverer(gw.nc, gw.cfg.Crash, shedLoad(s.Limits.Shed,
+			authenticate(s.Sessions.Auth, s.APIKeys, streamHandler(gw.nc, s.Sessions))))))
+	for _, route := range s.Routes {
+		var key ed25519.PrivateKey
+		if route.Action == "request" {
+			key = gw.signKey
+		}
+		var h http.Handler
+		action := route.Action
+		switch route.Action {
+		case "pipeline":
+			stages := s.Pipelines[route.Pipeline]
+			h = pipelineHandler(gw.nc, route, route.Pipeline, stages)
+			if !publishes(stages) {
+				// Gated like requests, since it does not publish
+				action = "request"
+			}
+		case "publish_reply":
+			h = withSession(handler(gw.nc, gw.js, route, key, gw.queue))
+		default:
+			h = handler(gw.nc, gw.js, route, key, gw.queue)
+		}
+		if route.Journal && gw.journal != nil {
+			h = journaled(gw.journal, route, h)
+		}
+		r.Methods("POST").Path(route.Path).Handler(
+			handlers.LoggingHandler(accessLog, measure(route.Name, recoverer(gw.nc, gw.cfg.Crash, shedLoad(s.Limits.Shed,
+				timeout(time.Duration(route.Timeout), latencyBudget(route.Name,
+					authenticate(route.Auth, s.APIKeys,
+						rateLimit(gw.store, route.Name, "rate_limit", "X-RateLimit", route.RateLimit,
+							rateLimit(gw.store, route.Name, "quota", "X-Quota", route.Quota,
+								stateGate(s.States, action,
+									readOnlyGate(action,
+										probeInterest(gw.nc, route, h)))))))))))))
+	}
+	return r
+}
+
+// adminRoutes builds the router for the admin API
+func (gw *gateway) adminRoutes() http.Handler {
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/admin/config").HandlerFunc(gw.exportConfig)
+	r.Methods("PUT").Path("/admin/config").HandlerFunc(gw.importConfig)
+	r.Methods("GET").Path("/admin/config/changes").HandlerFunc(gw.configChanges)
+	r.Methods("GET").Path("/admin/retention").HandlerFunc(gw.retention)
+	r.Methods("GET").Path("/admin/connection").HandlerFunc(gw.connectionStatus)
+	r.Methods("GET").Path("/admin/snapshot").HandlerFunc(gw.snapshot)
+	r.Methods("PUT", "DELETE").Path("/admin/read-only").HandlerFunc(gw.setReadOnly)
+	r.Methods("GET").Path("/admin/sessions").HandlerFunc(gw.sessionUsage)
+	r.Methods("GET").Path("/admin/schemas").HandlerFunc(gw.schemas)
+	r.Methods("DELETE").Path("/admin/schemas/{subject}").HandlerFunc(gw.forgetSchema)
+	r.Methods("GET").Path("/admin/retries").HandlerFunc(gw.retryList)
+	r.Methods("POST").Path("/admin/retries/{id}/retry").HandlerFunc(gw.retryNow)
+	r.Methods("DELETE").Path("/admin/retries/{id}").HandlerFunc(gw.retryDiscard)
+	r.Methods("GET").Path("/debug/vars").Handler(expvar.Handler())
+	return handlers.LoggingHandler(accessLog, r)
+}
+
+// configChanges lists the last config changes, most recent first
+func (gw *gateway) configChanges(w http.ResponseWriter, r *http.Request) {
+	keys, err := gw.store.Keys(changesPrefix)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+		return
+	}
+	changes := make([]configChange, 0, len(keys))
+	for i := len(keys) - 1; i >= 0; i-- {
+		data, err := gw.store.Get(keys[i])
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+			return
+		}
+		var change configChange
+		if err := json.Unmarshal(data, &change); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+			return
+		}
+		changes = append(changes, change)
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+// writeJSON sends v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status, body = http.StatusInternalServerError, []byte(`{"error":"encoding response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// newJetStream creates the JetStream context for the configured domain
+// or API prefix, needed to reach a hub JetStream through a leafnode
+func newJetStream(nc *nats.Conn, n natsConfig) (jetstream.JetStream, error) {
+	switch {
+	case n.JSDomain != "":
+		return jetstream.NewWithDomain(nc, n.JSDomain)
+	case n.JSAPIPrefix != "":
+		return jetstream.NewWithAPIPrefix(nc, n.JSAPIPrefix)
+	}
+	return jetstream.New(nc)
+}
+
+// validJSPrefix checks an API prefix, with or without the trailing dot
+func validJSPrefix(prefix string) bool {
+	return validSubject(strings.TrimSuffix(prefix, "."))
+}
+
+// jsInfo tells how the gateway reaches JetStream
+type jsInfo struct {
+	APIPrefix string `json:"api_prefix"`
+	// Domain is the one configured, EffectiveDomain the one reported by
+	// the server for the account
+	Domain          string `json:"domain,omitempty"`
+	EffectiveDomain string `json:"effective_domain,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// jetStreamInfo asks the server for the JetStream domain of the account
+func (gw *gateway) jetStreamInfo(ctx context.Context) jsInfo {
+	opts := gw.js.Options()
+	info := jsInfo{APIPrefix: opts.APIPrefix, Domain: opts.Domain}
+	ctx, cancel := context.WithTimeout(ctx, AdminTimeout)
+	defer cancel()
+	account, err := gw.js.AccountInfo(ctx)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.EffectiveDomain = account.Domain
+	return info
+}
+
+// jsPublishResult is the acknowledgement of a JetStream publish
+type jsPublishResult struct {
+	Stream    string `json:"stream"`
+	Sequence  uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// jsPublish is the publish action of JetStream routes. It waits for the
+// stream to store the message, compressed if configured, and uses the
+// Idempotency-Key of the request as message ID, so the stream drops
+// duplicates in its window.
+func jsPublish(js jetstream.JetStream, c *compressConfig) action {
+	return func(ctx context.Context, pub *nats.Conn, topic string, data []byte) ([]byte, int, error) {
+		msg := newMsg(ctx, topic, data)
+		if err := compressMsg(msg, c); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		var opts []jetstream.PublishOpt
+		if id, _ := ctx.Value(msgIDKey).(string); id != "" {
+			opts = append(opts, jetstream.WithMsgID(id))
+		}
+		watch := violations.watch(ctx, topic)
+		defer violations.release(topic, watch)
+		ack, err := js.PublishMsg(watch.ctx, msg, opts...)
+		if denied := watch.denied(); denied != nil {
+			err = denied
+		}
+		if err != nil {
+			return nil, natsStatus(err), err
+		}
+		reply, err := json.Marshal(jsPublishResult{ack.Stream, ack.Sequence, ack.Duplicate})
+		return reply, http.StatusOK, err
+	}
+}
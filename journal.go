@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// IdempotencyKeyHeader identifies a request across retries, for the
+// routes with a journal
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ReplayedHeader is set in the replies sent from the journal
+const ReplayedHeader = "Idempotent-Replayed"
+
+// DefaultJournalTTL is how long replies are kept when no TTL is configured
+const DefaultJournalTTL = 24 * time.Hour
+
+// journalMetrics counts the replies stored and replayed, and the
+// retries rejected
+var journalMetrics = expvar.NewMap("journal")
+
+// journalConfig sets the JetStream KV bucket of the request journal,
+// only applied on startup. The journal is disabled without a bucket.
+type journalConfig struct {
+	Bucket string `json:"bucket,omitempty"`
+	// TTL is how long the replies are kept, 24h by default
+	TTL duration `json:"ttl,omitempty"`
+}
+
+// validate checks the bucket name and TTL
+func (c journalConfig) validate() error {
+	if c.Bucket != "" && !validToken(c.Bucket) {
+		return fmt.Errorf("Invalid journal bucket %q", c.Bucket)
+	}
+	if c.TTL < 0 {
+		return errors.New("Negative journal ttl")
+	}
+	return nil
+}
+
+// journalEntry is a request in the journal. It is pending until the
+// reply is known.
+type journalEntry struct {
+	// Hash of the request path and body, to detect a key reused
+	// for a different request
+	Hash    string      `json:"hash"`
+	Started time.Time   `json:"started"`
+	Done    bool        `json:"done"`
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+}
+
+// journal keeps the replies of requests by idempotency key, so a retry
+// gets the original reply instead of running the request again
+type journal struct {
+	kv jetstream.KeyValue
+}
+
+// openJournal creates the KV bucket of the journal if missing
+func openJournal(js jetstream.JetStream, c journalConfig) (*journal, error) {
+	ttl := time.Duration(c.TTL)
+	if ttl == 0 {
+		ttl = DefaultJournalTTL
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: c.Bucket, TTL: ttl})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening journal bucket %s: %v", c.Bucket, err)
+	}
+	return &journal{kv: kv}, nil
+}
+
+// Errors claiming a key of the journal
+var (
+	errInProgress = errors.New("Request in progress")
+	errKeyReused  = errors.New("Idempotency key reused")
+)
+
+// claim marks the request as pending, or returns the reply if it is
+// done. A pending entry older than stale is taken over, since the
+// gateway that had it must have died.
+func (j *journal) claim(key, hash string, stale time.Duration) (*journalEntry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	pending, err := json.Marshal(journalEntry{Hash: hash, Started: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	_, err = j.kv.Create(ctx, key, pending)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, jetstream.ErrKeyExists) {
+		return nil, err
+	}
+	kve, err := j.kv.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var entry journalEntry
+	if err := json.Unmarshal(kve.Value(), &entry); err != nil {
+		return nil, err
+	}
+	switch {
+	case entry.Hash != hash:
+		return nil, errKeyReused
+	case entry.Done:
+		return &entry, nil
+	case time.Since(entry.Started) < stale:
+		return nil, errInProgress
+	}
+	if _, err := j.kv.Update(ctx, key, pending, kve.Revision()); err != nil {
+		// Another gateway took it over first
+		return nil, errInProgress
+	}
+	return nil, nil
+}
+
+// finish stores the reply of the request
+func (j *journal) finish(key string, entry journalEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	entry.Done = true
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = j.kv.Put(ctx, key, data)
+	return err
+}
+
+// release forgets the request, so a retry runs it again
+func (j *journal) release(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	return j.kv.Purge(ctx, key)
+}
+
+// journalWriter keeps a copy of the reply
+type journalWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *journalWriter) WriteHeader(code int) {
+	w.status = code
+	w.header = w.ResponseWriter.Header().Clone()
+	w.header.Del(RequestIDHeader)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *journalWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// journaled answers the requests with an idempotency key from the
+// journal, if they already have a reply, and stores the reply of the
+// new ones. Server errors are not stored, so the request can be retried.
+func journaled(j *journal, route routeConfig, next http.Handler) http.Handler {
+	stale := time.Duration(route.Deadline) * time.Duration(route.Retries+1)
+	if route.Timeout > 0 && time.Duration(route.Timeout) > stale {
+		stale = time.Duration(route.Timeout)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotencyKey := r.Header.Get(IdempotencyKeyHeader)
+		if idempotencyKey == "" || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxRequestSize))
+		r.Body.Close()
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid_request", err)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		// Keys are only unique per client, so the replies of one are
+		// never sent to another that picked the same key
+		sum := sha256.Sum256([]byte(route.Name + "\x00" + clientID(r) + "\x00" + idempotencyKey))
+		key := "req." + hex.EncodeToString(sum[:])
+		sum = sha256.Sum256(append([]byte(r.URL.Path+"\x00"), body...))
+		hash := hex.EncodeToString(sum[:])
+		entry, err := j.claim(key, hash, stale)
+		switch err {
+		case nil:
+		case errInProgress:
+			journalMetrics.Add("in_progress", 1)
+			writeError(w, r, http.StatusConflict, "request_in_progress", idempotencyKey)
+			return
+		case errKeyReused:
+			journalMetrics.Add("key_reused", 1)
+			writeError(w, r, http.StatusUnprocessableEntity, "idempotency_key_reused", idempotencyKey)
+			return
+		default:
+			log.Print("Error reading request journal: ", err)
+			journalMetrics.Add("errors", 1)
+			writeError(w, r, http.StatusServiceUnavailable, "journal_error", err)
+			return
+		}
+		if entry != nil {
+			journalMetrics.Add("replayed", 1)
+			for name, values := range entry.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set(ReplayedHeader, "true")
+			w.WriteHeader(entry.Status)
+			w.Write(entry.Body)
+			return
+		}
+		jw := &journalWriter{ResponseWriter: w}
+		next.ServeHTTP(jw, r)
+		if jw.status == 0 || jw.status >= 500 {
+			err = j.release(key)
+		} else {
+			err = j.finish(key, journalEntry{Hash: hash, Started: time.Now(), Status: jw.status, Header: jw.header, Body: jw.body.Bytes()})
+			journalMetrics.Add("stored", 1)
+		}
+		if err != nil {
+			log.Print("Error writing request journal: ", err)
+			journalMetrics.Add("errors", 1)
+		}
+	})
+}
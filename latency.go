@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// LatencyBudgetHeader carries the time left to answer a request, in
+// milliseconds. The gateway takes its own processing time out of it,
+// and forwards what is left in the NATS header of the same name.
+const LatencyBudgetHeader = "X-Latency-Budget"
+
+// budgetMetrics counts, by route, the requests with a latency budget,
+// the ones forwarded with no budget left, and the ones answered late
+var budgetMetrics = expvar.NewMap("latency_budget")
+
+// budget is the deadline of a request from its latency budget, kept in
+// the request context to forward what is left. It does not cancel the
+// request; the route timeout does.
+type budget struct {
+	route    string
+	deadline time.Time
+}
+
+// latencyBudget records the deadline of the request from its budget,
+// and counts the requests answered after it
+func latencyBudget(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get(LatencyBudgetHeader)
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		ms, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || ms < 0 {
+			writeError(w, r, http.StatusBadRequest, "invalid_latency_budget", LatencyBudgetHeader)
+			return
+		}
+		deadline := start.Add(time.Duration(ms) * time.Millisecond)
+		budgetMetrics.Add(route+".requests", 1)
+		ctx := context.WithValue(r.Context(), budgetKey, budget{route: route, deadline: deadline})
+		next.ServeHTTP(w, r.WithContext(ctx))
+		if time.Now().After(deadline) {
+			budgetMetrics.Add(route+".exceeded", 1)
+		}
+	})
+}
+
+// withBudget copies the latency budget of from into ctx
+func withBudget(ctx, from context.Context) context.Context {
+	if b, ok := from.Value(budgetKey).(budget); ok {
+		return context.WithValue(ctx, budgetKey, b)
+	}
+	return ctx
+}
+
+// newMsg builds the message for the subject, with the latency budget
+// left, if the request has one
+func newMsg(ctx context.Context, subject string, data []byte) *nats.Msg {
+	msg := &nats.Msg{Subject: subject, Data: data}
+	b, ok := ctx.Value(budgetKey).(budget)
+	if !ok {
+		return msg
+	}
+	left := time.Until(b.deadline)
+	if left <= 0 {
+		left = 0
+		budgetMetrics.Add(b.route+".exhausted", 1)
+	}
+	msg.Header = nats.Header{}
+	msg.Header.Set(LatencyBudgetHeader, strconv.FormatInt(left.Milliseconds(), 10))
+	return msg
+}
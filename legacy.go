@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// legacyValue is a connection setting given with the flags and env vars
+// used before the config file existed.
+type legacyValue struct {
+	// Source describes where the value came from, e.g. "-user flag"
+	Source string
+	// Setting is the config file setting it maps to, e.g. "nats.user"
+	Setting string
+	Value   string
+}
+
+// legacyLookup returns the flag value if set, or the env var otherwise
+func legacyLookup(flagValue, flagName, env string) (value, source string) {
+	if flagValue != "" {
+		return flagValue, fmt.Sprintf("-%s flag", flagName)
+	}
+	if v, ok := os.LookupEnv(env); ok && v != "" {
+		return v, fmt.Sprintf("%s env var", env)
+	}
+	return "", ""
+}
+
+// readLegacy collects the legacy -user, -pass, -host, -port, -test,
+// -inbox-prefix and -no-echo flags, and their NATS_USER, NATS_PASS,
+// NATS_HOST, NATS_PORT, NATS_TEST, NATS_INBOX_PREFIX and NATS_NO_ECHO
+// env vars.
+func readLegacy(user, pass, host string, port int, test, inboxPrefix string, noEcho bool) ([]legacyValue, error) {
+	var legacy []legacyValue
+	add := func(flagValue, flagName, env, setting string) (string, string) {
+		v, source := legacyLookup(flagValue, flagName, env)
+		if v != "" && setting != "" {
+			legacy = append(legacy, legacyValue{Source: source, Setting: setting, Value: v})
+		}
+		return v, source
+	}
+	add(user, "user", "NATS_USER", "nats.user")
+	add(pass, "pass", "NATS_PASS", "nats.pass")
+	add(test, "test", "NATS_TEST", "responder.subject")
+	add(inboxPrefix, "inbox-prefix", "NATS_INBOX_PREFIX", "nats.inbox_prefix")
+	echoFlag := ""
+	if noEcho {
+		echoFlag = "true"
+	}
+	if v, source := legacyLookup(echoFlag, "no-echo", "NATS_NO_ECHO"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s %q", source, v)
+		}
+		if b {
+			legacy = append(legacy, legacyValue{Source: source, Setting: "nats.no_echo", Value: v})
+		}
+	}
+	portFlag := ""
+	if port != 0 {
+		portFlag = strconv.Itoa(port)
+	}
+	h, hostSource := add(host, "host", "NATS_HOST", "")
+	p, portSource := add(portFlag, "port", "NATS_PORT", "")
+	if h == "" && p == "" {
+		return legacy, nil
+	}
+	if h == "" || p == "" {
+		return nil, fmt.Errorf("Both host and port are required, got only %s%s", hostSource, portSource)
+	}
+	if _, err := strconv.Atoi(p); err != nil {
+		return nil, fmt.Errorf("Invalid port %q in %s", p, portSource)
+	}
+	legacy = append(legacy, legacyValue{
+		Source:  hostSource + " and " + portSource,
+		Setting: "nats.url",
+		Value:   "tls://" + net.JoinHostPort(h, p),
+	})
+	return legacy, nil
+}
+
+// credentialSettings are migrated as a group, so the user from one
+// source is never combined with the password from another.
+var credentialSettings = map[string]bool{"nats.user": true, "nats.pass": true}
+
+// migrate copies the legacy values into the settings, unless the config
+// file already sets them, and warns about the deprecation. If the file
+// sets any credential, all the legacy credentials are ignored.
+func (c config) migrate(s *settings) {
+	fileCredentials := s.NATS.User != "" || s.NATS.Pass != ""
+	for _, l := range c.Legacy {
+		if credentialSettings[l.Setting] && fileCredentials {
+			log.Printf("WARNING: ignoring deprecated %s, the credentials are set in the config file", l.Source)
+			continue
+		}
+		set, assign := s.legacyTarget(l.Setting)
+		if set {
+			log.Printf("WARNING: ignoring deprecated %s, %s is set in the config file", l.Source, l.Setting)
+			continue
+		}
+		log.Printf("WARNING: deprecated %s, set %s in the config file instead", l.Source, l.Setting)
+		assign(l.Value)
+	}
+}
+
+// legacyTarget tells if the setting a legacy value maps to is already
+// set, and returns the function to set it
+func (s *settings) legacyTarget(setting string) (set bool, assign func(string)) {
+	text := func(p *string) (bool, func(string)) {
+		return *p != "", func(v string) { *p = v }
+	}
+	switch setting {
+	case "nats.url":
+		return text(&s.NATS.URL)
+	case "nats.user":
+		return text(&s.NATS.User)
+	case "nats.pass":
+		return text(&s.NATS.Pass)
+	case "nats.inbox_prefix":
+		return text(&s.NATS.InboxPrefix)
+	case "nats.no_echo":
+		return s.NATS.NoEcho, func(v string) { s.NATS.NoEcho, _ = strconv.ParseBool(v) }
+	case "responder.subject":
+		return text(&s.Responder.Subject)
+	}
+	panic("unknown legacy setting " + setting)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReadLegacy(t *testing.T) {
+	for _, env := range []string{"NATS_USER", "NATS_PASS", "NATS_HOST", "NATS_PORT", "NATS_TEST", "NATS_INBOX_PREFIX", "NATS_NO_ECHO"} {
+		if v, ok := os.LookupEnv(env); ok {
+			os.Unsetenv(env)
+			defer os.Setenv(env, v)
+		}
+	}
+	legacy, err := readLegacy("me", "secret", "nats.example.com", 4222, "", "_GW", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []legacyValue{
+		{Source: "-user flag", Setting: "nats.user", Value: "me"},
+		{Source: "-pass flag", Setting: "nats.pass", Value: "secret"},
+		{Source: "-inbox-prefix flag", Setting: "nats.inbox_prefix", Value: "_GW"},
+		{Source: "-no-echo flag", Setting: "nats.no_echo", Value: "true"},
+		{Source: "-host flag and -port flag", Setting: "nats.url", Value: "tls://nats.example.com:4222"},
+	}
+	if !reflect.DeepEqual(legacy, want) {
+		t.Errorf("readLegacy = %+v, want %+v", legacy, want)
+	}
+	if _, err := readLegacy("", "", "nats.example.com", 0, "", "", false); err == nil {
+		t.Error("readLegacy with a host and no port should fail")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	cfg := config{Legacy: []legacyValue{
+		{Source: "-user flag", Setting: "nats.user", Value: "legacy"},
+		{Source: "-pass flag", Setting: "nats.pass", Value: "secret"},
+		{Source: "-host flag and -port flag", Setting: "nats.url", Value: "tls://legacy:4222"},
+		{Source: "-test flag", Setting: "responder.subject", Value: "test"},
+		{Source: "-inbox-prefix flag", Setting: "nats.inbox_prefix", Value: "_GW"},
+		{Source: "-no-echo flag", Setting: "nats.no_echo", Value: "true"},
+	}}
+	tests := []struct {
+		name string
+		file settings
+		want settings
+	}{
+		{
+			name: "empty file takes the legacy values",
+			want: settings{
+				NATS:      natsConfig{URL: "tls://legacy:4222", User: "legacy", Pass: "secret", InboxPrefix: "_GW", NoEcho: true},
+				Responder: responderConfig{Subject: "test"},
+			},
+		},
+		{
+			name: "file wins",
+			file: settings{NATS: natsConfig{URL: "nats://file:4222", User: "file", InboxPrefix: "_FILE"}},
+			want: settings{
+				NATS:      natsConfig{URL: "nats://file:4222", User: "file", InboxPrefix: "_FILE", NoEcho: true},
+				Responder: responderConfig{Subject: "test"},
+			},
+		},
+		{
+			name: "file password ignores the legacy user",
+			file: settings{NATS: natsConfig{Pass: "file"}},
+			want: settings{
+				NATS:      natsConfig{URL: "tls://legacy:4222", Pass: "file", InboxPrefix: "_GW", NoEcho: true},
+				Responder: responderConfig{Subject: "test"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		s := tt.file
+		cfg.migrate(&s)
+		if !reflect.DeepEqual(s, tt.want) {
+			t.Errorf("%s: migrate = %+v, want %+v", tt.name, s, tt.want)
+		}
+	}
+}
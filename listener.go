@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listeners serve the gateway over HTTP/1.1, and also HTTP/2 and
+// HTTP/3 when TLS is configured.
+type listeners struct {
+	cfg  config
+	http *http.Server
+	h3   *http3.Server
+	ln   net.Listener
+	pc   net.PacketConn
+}
+
+// newListeners prepares the listeners for the handler
+func newListeners(cfg config, h http.Handler) (*listeners, error) {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("Both -tls-cert and -tls-key are required for TLS")
+	}
+	if cfg.HTTP3 && cfg.TLSCert == "" {
+		return nil, errors.New("HTTP/3 requires TLS, set -tls-cert and -tls-key")
+	}
+	if cfg.TLSClientCA != "" && cfg.TLSCert == "" {
+		return nil, errors.New("Client certificates require TLS, set -tls-cert and -tls-key")
+	}
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	l := &listeners{cfg: cfg}
+	if cfg.HTTP3 {
+		if l.pc, err = listenUDP("h3", cfg.Listen); err != nil {
+			return nil, err
+		}
+		l.h3 = &http3.Server{Addr: cfg.Listen, Handler: h, TLSConfig: tlsConfig}
+		h = l.advertise(h)
+	}
+	if l.ln, err = listenTCP("http", cfg.Listen); err != nil {
+		return nil, err
+	}
+	l.http = &http.Server{Addr: cfg.Listen, Handler: h, TLSConfig: tlsConfig}
+	return l, nil
+}
+
+// loadTLSConfig loads the certificate, and the client CAs if any.
+// Client certificates are verified if given, but not required, so
+// only the routes with mtls auth reject requests without one.
+func loadTLSConfig(cfg config) (*tls.Config, error) {
+	if cfg.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if cfg.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.TLSClientCA)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// advertise tells HTTP/1.1 and HTTP/2 clients that HTTP/3 is available
+func (l *listeners) advertise(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			l.h3.SetQUICHeaders(w.Header())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve blocks until the listeners are shut down, and returns
+// http.ErrServerClosed then.
+func (l *listeners) serve() error {
+	if l.h3 != nil {
+		go func() {
+			log.Printf("Waiting for HTTP/3 requests on %s", l.cfg.Listen)
+			if err := l.h3.Serve(l.pc); err != nil && err != http.ErrServerClosed {
+				log.Print("Error serving HTTP/3: ", err)
+			}
+		}()
+	}
+	if l.cfg.TLSCert != "" {
+		log.Printf("Waiting for HTTPS requests on %s", l.cfg.Listen)
+		return l.http.ServeTLS(l.ln, "", "")
+	}
+	log.Printf("Waiting for requests on %s", l.cfg.Listen)
+	return l.http.Serve(l.ln)
+}
+
+// shutdown stops accepting requests, and waits for the ones in flight
+func (l *listeners) shutdown(ctx context.Context) error {
+	if l.h3 != nil {
+		if err := l.h3.Shutdown(ctx); err != nil {
+			log.Print("Error shutting down HTTP/3 server: ", err)
+		}
+	}
+	return l.http.Shutdown(ctx)
+}
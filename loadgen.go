@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// LoadgenTick is the period between batches of load generator messages
+const LoadgenTick = 10 * time.Millisecond
+
+// loadgenConfig configures the load generator mode
+type loadgenConfig struct {
+	Subject     string
+	Queue       string
+	Subscribers int
+	Rate        float64
+	Size        int
+	Duration    time.Duration
+	Drain       time.Duration
+}
+
+// loadgenFlags registers the flags of the load generator mode
+func loadgenFlags() *loadgenConfig {
+	lg := &loadgenConfig{}
+	flag.StringVar(&lg.Subject, "subject", "loadgen", "Subject to publish the synthetic messages to")
+	flag.StringVar(&lg.Queue, "queue", "", "Queue group of the subscribers, empty for fan-out")
+	flag.IntVar(&lg.Subscribers, "subscribers", 1, "Number of subscribers measuring latency")
+	flag.Float64Var(&lg.Rate, "rate", 100, "Messages published per second")
+	flag.IntVar(&lg.Size, "size", 128, "Size of each message in bytes, at least 8")
+	flag.DurationVar(&lg.Duration, "duration", 10*time.Second, "How long to publish messages for")
+	flag.DurationVar(&lg.Drain, "drain", 2*time.Second, "How long to wait for messages in flight after publishing")
+	return lg
+}
+
+// runLoadgen publishes synthetic messages straight to NATS, and measures
+// the latency until subscribers receive them. Each message carries its
+// send time in the first 8 bytes.
+func runLoadgen(nc *nats.Conn, lg loadgenConfig) error {
+	if lg.Size < 8 {
+		return errors.New("Message size must be at least 8 bytes")
+	}
+	if lg.Rate <= 0 || lg.Subscribers <= 0 {
+		return errors.New("Rate and subscribers must be positive")
+	}
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		received  int64
+	)
+	for i := 0; i < lg.Subscribers; i++ {
+		sub, err := nc.QueueSubscribe(lg.Subject, lg.Queue, func(msg *nats.Msg) {
+			if len(msg.Data) < 8 {
+				return
+			}
+			sent := int64(binary.BigEndian.Uint64(msg.Data))
+			latency := time.Duration(time.Now().UnixNano() - sent)
+			atomic.AddInt64(&received, 1)
+			mu.Lock()
+			latencies = append(latencies, latency)
+			mu.Unlock()
+		})
+		if err != nil {
+			return err
+		}
+		defer sub.Unsubscribe()
+	}
+	if err := nc.Flush(); err != nil {
+		return err
+	}
+	log.Printf("Publishing %d byte messages to %s at %.0f msg/s for %s", lg.Size, lg.Subject, lg.Rate, lg.Duration)
+	var published, failed int64
+	payload := make([]byte, lg.Size)
+	perTick := lg.Rate * LoadgenTick.Seconds()
+	pending := 0.0
+	ticker := time.NewTicker(LoadgenTick)
+	end := time.After(lg.Duration)
+loop:
+	for {
+		select {
+		case <-end:
+			break loop
+		case <-ticker.C:
+			for pending += perTick; pending >= 1; pending-- {
+				binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+				if err := nc.Publish(lg.Subject, payload); err != nil {
+					failed++
+					continue
+				}
+				published++
+			}
+		}
+	}
+	ticker.Stop()
+	if err := nc.Flush(); err != nil {
+		return err
+	}
+	time.Sleep(lg.Drain)
+	expected := published
+	if lg.Queue == "" {
+		expected *= int64(lg.Subscribers)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	log.Printf("Published %d messages, %d failed", published, failed)
+	log.Printf("Received %d of %d expected messages", atomic.LoadInt64(&received), expected)
+	log.Print(latencyReport(latencies))
+	return nil
+}
+
+// latencyReport summarizes the latency distribution
+func latencyReport(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "No latencies measured"
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return fmt.Sprintf("Latency min %s, p50 %s, p90 %s, p99 %s, max %s",
+		latencies[0], percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), latencies[len(latencies)-1])
+}
@@ -1,78 +1,191 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/nats-io/go-nats"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
 )
 
 // MaxRequestSize is the maximum size of the POST body
 const MaxRequestSize = 16384
 
+// ShutdownTimeout is the time allowed to requests in flight on shutdown
+const ShutdownTimeout = 30 * time.Second
+
+// SessionDrainTimeout is the time allowed to streaming sessions to end
+// on shutdown, before they are closed. It is shorter than
+// ShutdownTimeout, so closed sessions still end gracefully.
+const SessionDrainTimeout = 20 * time.Second
+
 type config struct {
-	User string
-	Pass string
-	Host string
-	Port int
-	Test string
+	// Connection settings from the legacy flags and env vars
+	Legacy []legacyValue
+	// Topic where crash events are published
+	Crash string
+	// Overall handler timeouts for the /topics and /requests routes
+	TopicsTimeout   time.Duration
+	RequestsTimeout time.Duration
+	// Topics to send a request to before marking the gateway ready
+	Warmup []string
+	// Soft limits for process resources
+	Limits resourceLimits
+	// Path to the config file, reloaded on SIGHUP
+	File string
+	// Listen address for the admin API
+	Admin string
+	// Path to the Ed25519 key used to sign replies
+	SignKey string
+	// Path to the keys that encrypt the retry queue, by tenant
+	QueueKeys string
+	// Listen address of the gateway
+	Listen string
+	// Certificate and key to serve HTTPS, HTTP/2 and HTTP/3
+	TLSCert string
+	TLSKey  string
+	// CA to verify client certificates, for routes with mtls auth
+	TLSClientCA string
+	// Also serve HTTP/3 over QUIC, on the same port
+	HTTP3 bool
 }
 
 // Naive HTTP => NATS gateway
 // Receives GET requests to /topic/{topic}, and publishes the query parameters to the topic.
 func main() {
+	var lg *loadgenConfig
+	var sc *soakConfig
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "loadgen":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			lg = loadgenFlags()
+		case "soak":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			sc = soakFlags()
+		case soakServerCommand:
+			if err := runSoakServer(); err != nil {
+				log.Fatal("Error running the soak NATS server: ", err)
+			}
+			return
+		}
+	}
 	var cfg config
 	if err := cfg.read(); err != nil {
 		log.Fatal("Error reading config: ", err)
 	}
-	url := fmt.Sprintf("tls://%s:%s@%s:%d", cfg.User, cfg.Pass, cfg.Host, cfg.Port)
-	nc, err := nats.Connect(url)
+	if sc != nil {
+		if err := runSoak(cfg, *sc); err != nil {
+			log.Fatal("Soak test failed: ", err)
+		}
+		log.Print("Soak test passed")
+		return
+	}
+	initial, err := loadSettings(cfg)
+	if err != nil {
+		log.Fatal("Error loading config: ", err)
+	}
+	nc, err := nats.Connect(initial.NATS.URL, cfg.options(initial.NATS)...)
 	if err != nil {
 		log.Fatal("Error connecting to server: ", err)
 	}
+	connection.set(stateConnected)
 	defer nc.Close()
-	if cfg.Test != "" {
-		log.Printf("Running in test mode, subscribing to topic %s", cfg.Test)
-		s, err := nc.Subscribe(cfg.Test, func(msg *nats.Msg) {
-			log.Printf("Received message [%s] %s", msg.Subject, string(msg.Data))
-			if msg.Reply != "" {
-				log.Printf("Message [%s] requested reply to %s", msg.Subject, string(msg.Data))
-				reply := []byte(fmt.Sprintf("{ \"fulfillmentText\": \"mensaje recibido\", \"payload\": { \"google\": { \"expectUserResponse\": false } } }"))
-				if err := nc.Publish(msg.Reply, reply); err != nil {
-					log.Printf("Error replying to message [%s]: %+v", msg.Subject, err)
-				}
-			}
-		})
+	if lg != nil {
+		if err := runLoadgen(nc, *lg); err != nil {
+			log.Fatal("Error generating load: ", err)
+		}
+		return
+	}
+	if initial.Responder.Subject != "" || initial.Responder.Fixtures != "" {
+		log.Fatal(runResponder(nc, initial.Responder))
+	}
+	gw, err := newGateway(nc, cfg, initial)
+	if err != nil {
+		log.Fatal("Error starting gateway: ", err)
+	}
+	go monitorResources(gw.limits)
+	go gw.queue.run()
+	go gw.reloadOnSignal()
+	if cfg.Admin != "" {
+		ln, err := listenTCP("admin", cfg.Admin)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatal("Error listening for the admin API: ", err)
 		}
-		defer s.Unsubscribe()
-		log.Fatal(waitForInterrupt())
+		go func() {
+			log.Printf("Admin API listening on %s", cfg.Admin)
+			log.Fatal(http.Serve(ln, gw.adminRoutes()))
+		}()
 	}
-	addRoutes(nc)
-	log.Print("Waiting for requests on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	public := http.NewServeMux()
+	public.Handle("/", gw)
+	go func() {
+		runSmokeTests(nc, gw.js, initial.SmokeTests)
+		if err := warmUp(nc, cfg.Warmup); err != nil {
+			log.Fatal("Error warming up: ", err)
+		}
+		upgradeReady()
+	}()
+	server, err := newListeners(cfg, public)
+	if err != nil {
+		log.Fatal("Error configuring listeners: ", err)
+	}
+	go func() {
+		log.Print(waitForInterrupt())
+		shutdown(server, nc, gw.store)
+	}()
+	go upgradeOnSignal(func() { shutdown(server, nc, gw.store) })
+	if err := server.serve(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-connection.closed
 }
 
-// wait for Ctrl+C
+// shutdown stops accepting requests, waits for the ones in flight and
+// for streaming sessions to end, up to SessionDrainTimeout, closes the
+// store, and drains the NATS connection. On upgrades, the new process
+// opens the bolt store once it is closed here.
+func shutdown(server *listeners, nc *nats.Conn, st store) {
+	connection.set(stateDraining)
+	drained := time.AfterFunc(SessionDrainTimeout, sessions.closeAll)
+	defer drained.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.shutdown(ctx); err != nil {
+		log.Print("Error shutting down HTTP server: ", err)
+	}
+	if err := st.Close(); err != nil {
+		log.Print("Error closing store: ", err)
+	}
+	if err := nc.Drain(); err != nil {
+		log.Print("Error draining NATS connection: ", err)
+		nc.Close()
+	}
+}
+
+// wait for Ctrl+C or SIGTERM
 func waitForInterrupt() error {
 	var waiter sync.WaitGroup
 	var result os.Signal
 	waiter.Add(1)
 	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, os.Interrupt)
+	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		result = <-sigChannel
 		waiter.Done()
@@ -81,37 +194,95 @@ func waitForInterrupt() error {
 	return fmt.Errorf("Signal received: %+v", result)
 }
 
-// addRoutes adds the /topics and /requests routes
-func addRoutes(p *nats.Conn) {
-	r := mux.NewRouter()
-	r.Methods("POST").Path("/topics/{topic}").Handler(
-		handlers.LoggingHandler(os.Stdout, handler(p, topic)))
-	r.Methods("POST").Path("/requests/{topic}").Handler(
-		handlers.LoggingHandler(os.Stdout, handler(p, request)))
-	http.Handle("/", r)
-}
+// action processes a message for a topic, and returns the HTTP response.
+// NATS operations must not outlive the context.
+type action func(ctx context.Context, pub *nats.Conn, topic string, data []byte) (response []byte, status int, err error)
 
 // forPublisher creates a http.Handler for the given publisher
-func handler(pub *nats.Conn, f func(pub *nats.Conn, topic string, data []byte) (response []byte, status int, err error)) http.Handler {
+// If key is not nil, successful responses are signed with it.
+// Publishes that fail are queued if the route has a retry queue.
+func handler(pub *nats.Conn, js jetstream.JetStream, route routeConfig, key ed25519.PrivateKey, queue *retryQueue) http.Handler {
+	f := actions[route.Action]
+	if route.JetStream {
+		f = jsPublish(js, route.Compress)
+	}
+	subject, _ := parseSubject(route.Subject)
+	sampling := newSampler(route.Name, route.Sampling)
+	br := getBreaker(route.Name, route.Breaker)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sent := false
+		var closes time.Duration
 		topic, data, code, err := decode(r)
 		if err == nil {
-			data, code, err = f(pub, topic, data)
+			topic, code, err = subject.resolve(topic, data)
 		}
-		if data != nil {
-			w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		if err == nil && !sampling.keep(data) {
+			w.Header().Set(SampledHeader, "dropped")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err == nil {
+			sent = true
+			drift.observe(topic, data)
+			ctx, cancel := context.WithTimeout(r.Context(), time.Duration(route.Deadline))
+			defer cancel()
+			if id := r.Header.Get(IdempotencyKeyHeader); id != "" && route.JetStream {
+				ctx = context.WithValue(ctx, msgIDKey, id)
+			}
+			msg := data
+			call := func(ctx context.Context) ([]byte, int, error) {
+				return withRetry(ctx, route.Retries, route.retriesTimeouts(route.Action), func() ([]byte, int, error) {
+					return f(ctx, pub, topic, msg)
+				})
+			}
+			var allowed bool
+			if allowed, closes = br.allow(); !allowed {
+				data, code, err = nil, http.StatusServiceUnavailable, errCircuitOpen
+			} else {
+				if route.Action == "request" && wantsCoalescing(r) {
+					data, code, err = coalesce(ctx, topic, msg, time.Duration(route.Deadline), call)
+				} else {
+					data, code, err = call(ctx)
+				}
+				br.record(err)
+				if err != nil && route.Action != "request" {
+					readOnly.failure(err)
+				}
+			}
+			if err != nil && route.RetryQueue && classify(err).retryable() {
+				if id, qerr := queue.add(route.Name, tenantOf(apiKeyName(r)), topic, msg, err); qerr == nil {
+					data, code, err = []byte(fmt.Sprintf(`{"retry_id":%q}`, id)), http.StatusAccepted, nil
+				} else {
+					log.Print("Error queueing message: ", qerr)
+				}
+			}
 		}
-		w.WriteHeader(code)
 		if err != nil {
 			log.Print("NATS Error: ", err)
-			w.Write([]byte(err.Error()))
-		} else {
-			w.Write(data)
+			errCode := "invalid_request"
+			if sent {
+				errCode = natsCode(err)
+			}
+			if err == errCircuitOpen {
+				errCode = "circuit_open"
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(closes.Seconds()))))
+			}
+			writeError(w, r, code, errCode, err)
+			return
 		}
+		if data != nil {
+			w.Header().Add("Content-Type", "application/json; charset=utf-8")
+			if key != nil {
+				sign(w, key, data)
+			}
+		}
+		w.WriteHeader(code)
+		w.Write(data)
 	})
 }
 
-// decode the request body, get the topic and message
+// decode the request body, get the topic and message.
+// The topic is empty if the route has no {topic} variable.
 func decode(r *http.Request) (topic string, data []byte, status int, err error) {
 	// Always read the body to completion, and close it, before leaving
 	if r.Body != nil {
@@ -121,12 +292,7 @@ func decode(r *http.Request) (topic string, data []byte, status int, err error)
 		}()
 	}
 	// Get topic from URL
-	pvars := mux.Vars(r)
-	var ok bool
-	topic, ok = pvars["topic"]
-	if !ok || topic == "" {
-		return "", nil, http.StatusNotFound, errors.New("Missing topic")
-	}
+	topic = mux.Vars(r)["topic"]
 	// Check if there is a message body
 	if r.Body == nil {
 		return "", nil, http.StatusNotAcceptable, errors.New("missing topic body")
@@ -139,74 +305,145 @@ func decode(r *http.Request) (topic string, data []byte, status int, err error)
 	return topic, data, http.StatusOK, nil
 }
 
-// Topic handler
-func topic(pub *nats.Conn, topic string, data []byte) (response []byte, status int, err error) {
-	if err := pub.Publish(topic, data); err != nil {
-		return nil, http.StatusInternalServerError, err
+// Topic handler. Flushes after publishing, so a wedged connection
+// is reported before the deadline instead of silently buffering,
+// and so are the publishes denied by the server.
+func topic(ctx context.Context, pub *nats.Conn, topic string, data []byte) (response []byte, status int, err error) {
+	if err := publishMsg(ctx, pub, newMsg(ctx, topic, data)); err != nil {
+		return nil, natsStatus(err), err
 	}
 	return nil, http.StatusNoContent, nil
 }
 
-// Request handler
-func request(pub *nats.Conn, topic string, data []byte) (response []byte, status int, err error) {
-	msg, err := pub.Request(topic, data, 4*time.Second)
+// publishMsg publishes and flushes the message, and reports if the
+// server denied it
+func publishMsg(ctx context.Context, pub *nats.Conn, msg *nats.Msg) error {
+	watch := violations.watch(ctx, msg.Subject)
+	defer violations.release(msg.Subject, watch)
+	last := pub.LastError()
+	if err := pub.PublishMsg(msg); err != nil {
+		return err
+	}
+	err := pub.FlushWithContext(watch.ctx)
+	if denied := watch.denied(); denied != nil {
+		return denied
+	}
+	if denied := lastViolation(pub, last, msg.Subject); denied != nil {
+		return denied
+	}
+	return err
+}
+
+// Request handler. A denied request fails as soon as the server
+// reports it, instead of waiting for the deadline.
+func request(ctx context.Context, pub *nats.Conn, topic string, data []byte) (response []byte, status int, err error) {
+	watch := violations.watch(ctx, topic)
+	defer violations.release(topic, watch)
+	msg, err := pub.RequestMsgWithContext(watch.ctx, newMsg(ctx, topic, data))
+	if denied := watch.denied(); denied != nil {
+		err = denied
+	}
 	if err != nil {
-		return nil, http.StatusInternalServerError, err
+		return nil, natsStatus(err), err
 	}
-	return msg.Data, http.StatusOK, nil
+	if data, err = payload(msg); err != nil {
+		return nil, http.StatusBadGateway, err
+	}
+	return data, http.StatusOK, nil
+}
+
+// options builds the NATS connection options
+func (c *config) options(n natsConfig) []nats.Option {
+	opts := append(connection.options(), nats.ErrorHandler(violations.handler))
+	if n.User != "" {
+		opts = append(opts, nats.UserInfo(n.User, n.Pass))
+	}
+	if n.InboxPrefix != "" {
+		opts = append(opts, nats.CustomInboxPrefix(n.InboxPrefix))
+	}
+	if n.NoEcho {
+		opts = append(opts, nats.NoEcho())
+	}
+	return opts
 }
 
 // read config from command line / environment
 func (c *config) read() error {
-	user := flag.String("user", "", "NATS username")
-	pass := flag.String("pass", "", "NATS password")
-	host := flag.String("host", "", "NATS server address")
-	port := flag.Int("port", 0, "NATS server port")
-	test := flag.String("test", "", "Subscribe to this topic, for testing")
+	user := flag.String("user", "", "NATS username (deprecated, use nats.user in the config file)")
+	pass := flag.String("pass", "", "NATS password (deprecated, use nats.pass in the config file)")
+	host := flag.String("host", "", "NATS server address (deprecated, use nats.url in the config file)")
+	port := flag.Int("port", 0, "NATS server port (deprecated, use nats.url in the config file)")
+	test := flag.String("test", "", "Subscribe to this topic, for testing (deprecated, use responder.subject in the config file)")
+	crash := flag.String("crash", "", "Publish crash events to this topic")
+	topicsTimeout := flag.Duration("topics-timeout", 10*time.Second, "Overall timeout for /topics requests")
+	requestsTimeout := flag.Duration("requests-timeout", 10*time.Second, "Overall timeout for /requests requests")
+	warmup := flag.String("warmup", "", "Comma-separated topics to send a request to before becoming ready")
+	maxGoroutines := flag.Int("max-goroutines", 0, "Soft limit of goroutines, 0 to disable")
+	maxFDs := flag.Int("max-fds", 0, "Soft limit of open file descriptors, 0 to disable")
+	maxHeap := flag.Uint64("max-heap", 0, "Soft limit of heap memory in MB, 0 to disable")
+	file := flag.String("config", "", "Config file with routes and limits, reloaded on SIGHUP")
+	admin := flag.String("admin", "localhost:8081", "Listen address for the admin API, empty to disable")
+	signKey := flag.String("sign-key", "", "PEM file with the Ed25519 private key to sign replies")
+	queueKeys := flag.String("queue-keys", "", "JSON file with the keys to encrypt the retry queue, by API key name")
+	inboxPrefix := flag.String("inbox-prefix", "", "Prefix for reply inboxes, instead of _INBOX (deprecated, use nats.inbox_prefix in the config file)")
+	noEcho := flag.Bool("no-echo", false, "Do not receive messages published by the gateway itself (deprecated, use nats.no_echo in the config file)")
+	listen := flag.String("listen", ":8080", "Listen address of the gateway")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file, to serve HTTPS and HTTP/2")
+	tlsKey := flag.String("tls-key", "", "PEM key file of the certificate")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM file with the CAs to verify client certificates, for mtls routes")
+	http3 := flag.Bool("http3", false, "Also serve HTTP/3 over QUIC, requires -tls-cert and -tls-key")
 	flag.Parse()
-	if user == nil || *user == "" {
-		v, ok := os.LookupEnv("NATS_USER")
-		if !ok {
-			return errors.New("Missing both -user flag and NATS_USER env var")
-		}
-		user = &v
+	legacy, err := readLegacy(*user, *pass, *host, *port, *test, *inboxPrefix, *noEcho)
+	if err != nil {
+		return err
 	}
-	if pass == nil || *pass == "" {
-		v, ok := os.LookupEnv("NATS_PASS")
-		if !ok {
-			return errors.New("Missing both -pass flag and NATS_PASS env var")
+	if crash == nil || *crash == "" {
+		if v, ok := os.LookupEnv("NATS_CRASH"); ok {
+			crash = &v
 		}
-		pass = &v
 	}
-	if host == nil || *host == "" {
-		v, ok := os.LookupEnv("NATS_HOST")
-		if !ok {
-			return errors.New("Missing both -pass flag and NATS_PASS env var")
+	if warmup == nil || *warmup == "" {
+		if v, ok := os.LookupEnv("NATS_WARMUP"); ok {
+			warmup = &v
 		}
-		host = &v
 	}
-	if port == nil || *port == 0 {
-		v, ok := os.LookupEnv("NATS_HOST")
-		if !ok {
-			return errors.New("Missing both -pass flag and NATS_PASS env var")
+	if file == nil || *file == "" {
+		if v, ok := os.LookupEnv("NATS_CONFIG"); ok {
+			file = &v
 		}
-		p, err := strconv.Atoi(v)
-		if err != nil {
-			return err
+	}
+	if signKey == nil || *signKey == "" {
+		if v, ok := os.LookupEnv("NATS_SIGN_KEY"); ok {
+			signKey = &v
 		}
-		port = &p
 	}
-	if test == nil || *test == "" {
-		if v, ok := os.LookupEnv("NATS_TEST"); ok {
-			test = &v
+	if queueKeys == nil || *queueKeys == "" {
+		if v, ok := os.LookupEnv("NATS_QUEUE_KEYS"); ok {
+			queueKeys = &v
 		}
 	}
-	c.User = *user
-	c.Pass = *pass
-	c.Host = *host
-	c.Port = *port
-	if test != nil {
-		c.Test = *test
+	c.Legacy = legacy
+	if crash != nil {
+		c.Crash = *crash
+	}
+	c.TopicsTimeout = *topicsTimeout
+	c.RequestsTimeout = *requestsTimeout
+	if warmup != nil && *warmup != "" {
+		c.Warmup = strings.Split(*warmup, ",")
+	}
+	c.Limits = resourceLimits{
+		Goroutines: *maxGoroutines,
+		FDs:        *maxFDs,
+		HeapBytes:  *maxHeap << 20,
 	}
+	c.File = *file
+	c.Admin = *admin
+	c.SignKey = *signKey
+	c.QueueKeys = *queueKeys
+	c.Listen = *listen
+	c.TLSCert = *tlsCert
+	c.TLSKey = *tlsKey
+	c.TLSClientCA = *tlsClientCA
+	c.HTTP3 = *http3
 	return nil
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultLanguage is used when the client accepts none of the catalog
+const DefaultLanguage = "en"
+
+// builtinMessages is the catalog of error messages, by language and
+// error code. Codes are stable, messages may change; each message takes
+// the same arguments in every language.
+var builtinMessages = map[string]map[string]string{
+	"en": {
+		"invalid_api_key":        "missing or invalid API key",
+		"client_cert_required":   "client certificate required",
+		"connection_state":       "NATS connection %s",
+		"invalid_request":        "invalid request: %s",
+		"invalid_config":         "invalid config: %s",
+		"internal_error":         "internal error: %s",
+		"server_error":           "internal server error",
+		"handler_timeout":        "handler timeout",
+		"overloaded":             "the gateway is overloaded, retry later",
+		"no_responders":          "no responders for %s",
+		"rate_limit_exceeded":    "rate limit exceeded",
+		"quota_exceeded":         "quota exceeded",
+		"missing_subject":        "missing subject",
+		"jetstream_error":        "JetStream error: %s",
+		"streaming_unsupported":  "streaming not supported",
+		"missing_session":        "missing %s header",
+		"invalid_latency_budget": "invalid %s header, expected milliseconds",
+		"journal_error":          "request journal error: %s",
+		"request_in_progress":    "request with idempotency key %s in progress",
+		"idempotency_key_reused": "idempotency key %s used for a different request",
+		"validation_failed":      "validation failed: %s",
+		"transform_failed":       "transform failed: %s",
+		"enrich_failed":          "enrich failed: %s",
+		"unknown_session":        "unknown session %s",
+		"unknown_message":        "unknown queued message %s",
+		"retry_in_progress":      "queued message %s is being published",
+		"unknown_schema":         "no payload shape learned for %s",
+		"read_only":              "the gateway is read-only, publishing is disabled",
+		"subject_not_allowed":    "subscribing to %s is not allowed",
+		"session_quota_exceeded": "too many streaming sessions",
+		"subject_quota_exceeded": "too many subscribed subjects",
+		"nats_unavailable":       "NATS unavailable: %s",
+		"circuit_open":           "route unavailable, retry later: %s",
+		"nats_timeout":           "NATS timeout: %s",
+		"nats_denied":            "NATS permission denied: %s",
+		"nats_invalid":           "invalid NATS message: %s",
+		"nats_internal":          "NATS error: %s",
+	},
+	"es": {
+		"invalid_api_key":        "clave de API ausente o no válida",
+		"client_cert_required":   "se requiere un certificado de cliente",
+		"connection_state":       "conexión NATS en estado %s",
+		"invalid_request":        "petición no válida: %s",
+		"invalid_config":         "configuración no válida: %s",
+		"internal_error":         "error interno: %s",
+		"server_error":           "error interno del servidor",
+		"handler_timeout":        "tiempo de espera agotado",
+		"overloaded":             "la pasarela está sobrecargada, reinténtalo más tarde",
+		"no_responders":          "nadie responde en %s",
+		"rate_limit_exceeded":    "límite de peticiones superado",
+		"quota_exceeded":         "cuota superada",
+		"missing_subject":        "falta el subject",
+		"jetstream_error":        "error de JetStream: %s",
+		"streaming_unsupported":  "streaming no soportado",
+		"missing_session":        "falta la cabecera %s",
+		"invalid_latency_budget": "cabecera %s no válida, se esperan milisegundos",
+		"journal_error":          "error del diario de peticiones: %s",
+		"request_in_progress":    "la petición con clave de idempotencia %s está en curso",
+		"idempotency_key_reused": "la clave de idempotencia %s se usó en otra petición",
+		"validation_failed":      "validación fallida: %s",
+		"transform_failed":       "transformación fallida: %s",
+		"enrich_failed":          "enriquecimiento fallido: %s",
+		"unknown_session":        "sesión desconocida %s",
+		"unknown_message":        "mensaje en cola desconocido %s",
+		"retry_in_progress":      "el mensaje en cola %s se está publicando",
+		"unknown_schema":         "no se conoce la forma de los mensajes de %s",
+		"read_only":              "la pasarela está en modo solo lectura, no se puede publicar",
+		"subject_not_allowed":    "no se permite suscribirse a %s",
+		"session_quota_exceeded": "demasiadas sesiones de streaming",
+		"subject_quota_exceeded": "demasiados subjects suscritos",
+		"nats_unavailable":       "NATS no disponible: %s",
+		"circuit_open":           "ruta no disponible, reinténtalo más tarde: %s",
+		"nats_timeout":           "tiempo de espera de NATS agotado: %s",
+		"nats_denied":            "permiso denegado por NATS: %s",
+		"nats_invalid":           "mensaje NATS no válido: %s",
+		"nats_internal":          "error de NATS: %s",
+	},
+}
+
+// messages is the catalog in use, the builtin one with the messages
+// from the config file on top
+var messages atomic.Value // map[string]map[string]string
+
+func init() {
+	messages.Store(builtinMessages)
+}
+
+// mergeMessages adds the messages from the config file to the builtin
+// catalog. They must use known codes, and take the same arguments.
+func mergeMessages(extra map[string]map[string]string) (map[string]map[string]string, error) {
+	catalog := make(map[string]map[string]string, len(builtinMessages)+len(extra))
+	for lang, msgs := range builtinMessages {
+		catalog[lang] = msgs
+	}
+	for lang, msgs := range extra {
+		lang = strings.ToLower(lang)
+		merged := make(map[string]string, len(builtinMessages[DefaultLanguage]))
+		for code, msg := range catalog[lang] {
+			merged[code] = msg
+		}
+		for code, msg := range msgs {
+			def, ok := builtinMessages[DefaultLanguage][code]
+			if !ok {
+				return nil, fmt.Errorf("Unknown error code %q in %s messages", code, lang)
+			}
+			if strings.Count(msg, "%") != strings.Count(def, "%") {
+				return nil, fmt.Errorf("Message %s in %s must take the same arguments as %q", code, lang, def)
+			}
+			merged[code] = msg
+		}
+		catalog[lang] = merged
+	}
+	return catalog, nil
+}
+
+// localize returns the message for the code in the language preferred
+// by the client, and that language
+func localize(r *http.Request, code string, args ...interface{}) (string, string) {
+	catalog := messages.Load().(map[string]map[string]string)
+	for _, lang := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if msg, ok := catalog[lang][code]; ok {
+			return fmt.Sprintf(msg, args...), lang
+		}
+	}
+	msg, ok := catalog[DefaultLanguage][code]
+	if !ok {
+		msg = code
+	}
+	return fmt.Sprintf(msg, args...), DefaultLanguage
+}
+
+// acceptedLanguages lists the primary language tags of an
+// Accept-Language header, by preference
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if i := strings.IndexByte(lang, '-'); i > 0 {
+			lang = lang[:i]
+		}
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if v := strings.TrimSpace(f); strings.HasPrefix(v, "q=") {
+				if parsed, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	result := make([]string, len(langs))
+	for i, l := range langs {
+		result[i] = l.lang
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"es", []string{"es"}},
+		{"es-ES,en;q=0.5", []string{"es", "en"}},
+		{"en;q=0.3, ES-mx;q=0.9, fr", []string{"fr", "es", "en"}},
+		{"de;q=0, *;q=0.1, en", []string{"en"}},
+		{"pt;q=bad, it;q=0.5", []string{"pt", "it"}},
+	}
+	for _, tt := range tests {
+		if got := acceptedLanguages(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("acceptedLanguages(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestMergeMessages(t *testing.T) {
+	tests := []struct {
+		name    string
+		extra   map[string]map[string]string
+		lang    string
+		code    string
+		want    string
+		wantErr bool
+	}{
+		{"builtin", nil, "es", "no_responders", builtinMessages["es"]["no_responders"], false},
+		{"new language", map[string]map[string]string{"FR": {"no_responders": "aucun répondeur pour %s"}}, "fr", "no_responders", "aucun répondeur pour %s", false},
+		{"override", map[string]map[string]string{"es": {"no_responders": "sin respuesta en %s"}}, "es", "no_responders", "sin respuesta en %s", false},
+		{"keeps builtin", map[string]map[string]string{"es": {"no_responders": "sin respuesta en %s"}}, "es", "internal_error", builtinMessages["es"]["internal_error"], false},
+		{"unknown code", map[string]map[string]string{"fr": {"no_such_code": "non"}}, "", "", "", true},
+		{"other arguments", map[string]map[string]string{"fr": {"no_responders": "aucun répondeur"}}, "", "", "", true},
+	}
+	for _, tt := range tests {
+		catalog, err := mergeMessages(tt.extra)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := catalog[tt.lang][tt.code]; got != tt.want {
+			t.Errorf("%s: %s in %s = %q, want %q", tt.name, tt.code, tt.lang, got, tt.want)
+		}
+	}
+	if _, err := mergeMessages(map[string]map[string]string{"es": {"no_responders": "x %s"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := builtinMessages["es"]["no_responders"]; got == "x %s" {
+		t.Errorf("mergeMessages changed the builtin catalog")
+	}
+}
@@ -0,0 +1,8 @@
+package main
+
+import "expvar"
+
+// Gateway metrics, published by expvar under /debug/vars in the admin API
+var (
+	panicCount = expvar.NewInt("panics")
+)
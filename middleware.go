@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// RequestIDHeader carries the request ID, both in requests and responses
+const RequestIDHeader = "X-Request-Id"
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	apiKeyNameKey
+	sessionKey
+	budgetKey
+	msgIDKey
+)
+
+// requestID returns the ID assigned to the request by the recovery middleware
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// crashEvent is published to the crash topic when a handler panics
+type crashEvent struct {
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	URL       string    `json:"url"`
+	Panic     string    `json:"panic"`
+	Stack     string    `json:"stack"`
+}
+
+// recoverer tags the request with an ID and turns panics into 500 responses.
+// If crashTopic is not empty, a crashEvent is published there too.
+func recoverer(pub *nats.Conn, crashTopic string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort, let net/http deal with it
+				panic(v)
+			}
+			stack := debug.Stack()
+			panicCount.Add(1)
+			log.Printf("Panic serving request %s %s %s: %v\n%s", id, r.Method, r.URL, v, stack)
+			if crashTopic != "" {
+				event, err := json.Marshal(crashEvent{
+					RequestID: id,
+					Time:      time.Now(),
+					Method:    r.Method,
+					URL:       r.URL.String(),
+					Panic:     fmt.Sprint(v),
+					Stack:     string(stack),
+				})
+				if err == nil {
+					err = pub.Publish(crashTopic, event)
+				}
+				if err != nil {
+					log.Printf("Error publishing crash event for request %s: %+v", id, err)
+				}
+			}
+			writeError(w, r, http.StatusInternalServerError, "server_error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorBody is the JSON body of error responses
+type errorBody struct {
+	// Code identifies the error, and does not change with the language
+	Code      string `json:"code"`
+	Error     string `json:"error"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeError sends a JSON error response, with the message for the code
+// in the language preferred by the client
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, args ...interface{}) {
+	msg, lang := localize(r, code, args...)
+	body, _ := json.Marshal(errorBody{Code: code, Error: msg, RequestID: requestID(r)})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(status)
+	w.Write(body)
+}
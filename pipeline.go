@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// pipelineMetrics counts the calls, errors and time spent in each stage,
+// by pipeline and stage name
+var pipelineMetrics = expvar.NewMap("pipelines")
+
+// Stage types
+const (
+	stageValidate  = "validate"
+	stageTransform = "transform"
+	stageEnrich    = "enrich"
+	stagePublish   = "publish"
+	stageRespond   = "respond"
+)
+
+// stageConfig is a step of a pipeline. Each type uses some of the fields.
+type stageConfig struct {
+	// Name identifies the stage in metrics, the type by default
+	Name string `json:"name,omitempty"`
+	// Type is validate, transform, enrich, publish or respond
+	Type string `json:"type"`
+	// Require lists the JSON paths the message must have, for validate
+	Require []string `json:"require,omitempty"`
+	// MaxBytes is the largest message allowed by validate, 0 for any
+	MaxBytes int `json:"max_bytes,omitempty"`
+	// Set and Remove change fields of the message by JSON path, for transform
+	Set    map[string]interface{} `json:"set,omitempty"`
+	Remove []string               `json:"remove,omitempty"`
+	// Subject template to send the message to, for enrich and publish
+	Subject string `json:"subject,omitempty"`
+	// Into is where enrich puts the reply in the message, the reply
+	// replaces the message if empty
+	Into string `json:"into,omitempty"`
+	// Status (200 by default) and Body ("message" by default, or
+	// "none") of the response, for respond
+	Status int    `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+// validatePipeline checks the stages of a pipeline. respond can only be
+// the last one.
+func validatePipeline(name string, stages []stageConfig) error {
+	if len(stages) == 0 {
+		return fmt.Errorf("Pipeline %s has no stages", name)
+	}
+	names := make(map[string]bool)
+	for i, st := range stages {
+		if names[st.name()] {
+			return fmt.Errorf("Pipeline %s has duplicate stage %s", name, st.name())
+		}
+		names[st.name()] = true
+		if err := st.validate(); err != nil {
+			return fmt.Errorf("Pipeline %s stage %s: %v", name, st.name(), err)
+		}
+		if st.Type == stageRespond && i != len(stages)-1 {
+			return fmt.Errorf("Pipeline %s: respond must be the last stage", name)
+		}
+	}
+	return nil
+}
+
+// name of the stage in metrics
+func (st stageConfig) name() string {
+	if st.Name != "" {
+		return st.Name
+	}
+	return st.Type
+}
+
+// setPaths returns the paths of Set, sorted so they are always applied
+// in the same order, and a field after the object that contains it
+func (st stageConfig) setPaths() []string {
+	paths := make([]string, 0, len(st.Set))
+	for path := range st.Set {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// validate checks the stage has the fields its type needs
+func (st stageConfig) validate() error {
+	paths := append(append([]string{}, st.Require...), st.Remove...)
+	for path := range st.Set {
+		paths = append(paths, path)
+	}
+	if st.Into != "" {
+		paths = append(paths, st.Into)
+	}
+	for _, path := range paths {
+		if _, err := splitPath(path); err != nil {
+			return err
+		}
+	}
+	for _, path := range st.Remove {
+		if keys, _ := splitPath(path); len(keys) == 0 || strings.HasPrefix(keys[len(keys)-1], "[") {
+			return fmt.Errorf("Only object fields can be removed, not %s", path)
+		}
+	}
+	switch st.Type {
+	case stageValidate:
+		if st.MaxBytes < 0 {
+			return errors.New("Negative max_bytes")
+		}
+	case stageTransform:
+	case stageEnrich, stagePublish:
+		if st.Subject == "" {
+			return errors.New("Missing subject")
+		}
+		if _, err := parseSubject(st.Subject); err != nil {
+			return err
+		}
+	case stageRespond:
+		if st.Status != 0 && (st.Status < 200 || st.Status > 599) {
+			return fmt.Errorf("Invalid status %d", st.Status)
+		}
+		switch st.Body {
+		case "", "message", "none":
+		default:
+			return fmt.Errorf("Unknown body %q", st.Body)
+		}
+	default:
+		return fmt.Errorf("Unknown stage type %q", st.Type)
+	}
+	return nil
+}
+
+// publishes is true if any stage of the pipeline publishes
+func publishes(stages []stageConfig) bool {
+	for _, st := range stages {
+		if st.Type == stagePublish {
+			return true
+		}
+	}
+	return false
+}
+
+// stageError is a failed stage, with the response to send
+type stageError struct {
+	status int
+	code   string
+	err    error
+}
+
+// pipelineHandler runs the stages of the pipeline, in order, on the
+// request body. Without a respond stage, it answers 204.
+func pipelineHandler(pub *nats.Conn, route routeConfig, pipeline string, stages []stageConfig) http.Handler {
+	br := getBreaker(route.Name, route.Breaker)
+	subjects := make([]subjectTemplate, len(stages))
+	for i, st := range stages {
+		if st.Subject != "" {
+			subjects[i], _ = parseSubject(st.Subject)
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		topic, data, code, err := decode(r)
+		if err != nil {
+			writeError(w, r, code, "invalid_request", err)
+			return
+		}
+		for i, st := range stages {
+			metric := pipeline + "." + st.name()
+			start := time.Now()
+			var failed *stageError
+			data, failed = st.run(r.Context(), pub, route, br, subjects[i], topic, data)
+			pipelineMetrics.Add(metric+".calls", 1)
+			pipelineMetrics.AddFloat(metric+".seconds", time.Since(start).Seconds())
+			if failed != nil {
+				pipelineMetrics.Add(metric+".errors", 1)
+				log.Printf("Pipeline %s stage %s failed: %v", pipeline, st.name(), failed.err)
+				writeError(w, r, failed.status, failed.code, failed.err)
+				return
+			}
+			if st.Type == stageRespond {
+				status := st.Status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				if st.Body == "none" {
+					w.WriteHeader(status)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(status)
+				w.Write(data)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// run applies the stage to the message, and returns the new one
+func (st stageConfig) run(ctx context.Context, pub *nats.Conn, route routeConfig, br *breaker, subject subjectTemplate, topic string, data []byte) ([]byte, *stageError) {
+	switch st.Type {
+	case stageValidate:
+		if st.MaxBytes > 0 && len(data) > st.MaxBytes {
+			return nil, &stageError{http.StatusRequestEntityTooLarge, "validation_failed", fmt.Errorf("message larger than %d bytes", st.MaxBytes)}
+		}
+		if len(st.Require) == 0 {
+			return data, nil
+		}
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, &stageError{http.StatusUnprocessableEntity, "validation_failed", err}
+		}
+		for _, path := range st.Require {
+			if _, err := lookupJSON(doc, path); err != nil {
+				return nil, &stageError{http.StatusUnprocessableEntity, "validation_failed", err}
+			}
+		}
+		return data, nil
+	case stageTransform:
+		var doc interface{}
+		err := json.Unmarshal(data, &doc)
+		for _, path := range st.setPaths() {
+			if err == nil {
+				doc, err = setJSON(doc, path, st.Set[path])
+			}
+		}
+		for _, path := range st.Remove {
+			if err == nil {
+				err = removeJSON(doc, path)
+			}
+		}
+		if err == nil {
+			data, err = json.Marshal(doc)
+		}
+		if err != nil {
+			return nil, &stageError{http.StatusUnprocessableEntity, "transform_failed", err}
+		}
+		return data, nil
+	case stageEnrich, stagePublish:
+		target, status, err := subject.resolve(topic, data)
+		if err != nil {
+			return nil, &stageError{status, "invalid_request", err}
+		}
+		kind := "request"
+		if st.Type == stagePublish {
+			kind = "publish"
+		}
+		f := actions[kind]
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(route.Deadline))
+		defer cancel()
+		if allowed, _ := br.allow(); !allowed {
+			return nil, &stageError{http.StatusServiceUnavailable, "circuit_open", errCircuitOpen}
+		}
+		reply, status, err := withRetry(ctx, route.Retries, route.retriesTimeouts(kind), func() ([]byte, int, error) {
+			return f(ctx, pub, target, data)
+		})
+		br.record(err)
+		if err != nil {
+			if st.Type == stagePublish {
+				readOnly.failure(err)
+			}
+			return nil, &stageError{status, natsCode(err), err}
+		}
+		if st.Type == stagePublish {
+			return data, nil
+		}
+		return enrich(data, reply, st.Into)
+	}
+	return data, nil
+}
+
+// enrich puts the reply in the message at the path, or replaces the
+// message with it if the path is empty
+func enrich(data, reply []byte, into string) ([]byte, *stageError) {
+	if into == "" {
+		return reply, nil
+	}
+	var doc, value interface{}
+	err := json.Unmarshal(data, &doc)
+	if err == nil {
+		err = json.Unmarshal(reply, &value)
+	}
+	if err == nil {
+		doc, err = setJSON(doc, into, value)
+	}
+	if err == nil {
+		data, err = json.Marshal(doc)
+	}
+	if err != nil {
+		return nil, &stageError{http.StatusBadGateway, "enrich_failed", err}
+	}
+	return data, nil
+}
+
+// setJSON sets the value at path in a decoded JSON document, creating
+// the missing objects on the way, and returns the document
+func setJSON(doc interface{}, path string, value interface{}) (interface{}, error) {
+	keys, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return value, nil
+	}
+	if doc == nil {
+		doc = make(map[string]interface{})
+	}
+	v := doc
+	for i, key := range keys {
+		last := i == len(keys)-1
+		if strings.HasPrefix(key, "[") {
+			arr, ok := v.([]interface{})
+			n, _ := strconv.Atoi(key[1 : len(key)-1])
+			if !ok || n < 0 || n >= len(arr) {
+				return nil, fmt.Errorf("%s: %w", path, errNoField)
+			}
+			if last {
+				arr[n] = value
+			}
+			v = arr[n]
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: not an object", path)
+		}
+		if last {
+			obj[key] = value
+			continue
+		}
+		if _, ok := obj[key]; !ok {
+			obj[key] = make(map[string]interface{})
+		}
+		v = obj[key]
+	}
+	return doc, nil
+}
+
+// removeJSON deletes the field at path from a decoded JSON document, if
+// it is there. Array items can't be removed.
+func removeJSON(doc interface{}, path string) error {
+	i := strings.LastIndexAny(path, ".[")
+	if i <= 0 || path[i] == '[' {
+		return fmt.Errorf("%s: only object fields can be removed", path)
+	}
+	parent, err := lookupJSON(doc, path[:i])
+	if errors.Is(err, errNoField) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if obj, ok := parent.(map[string]interface{}); ok {
+		delete(obj, path[i+1:])
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidatePipeline(t *testing.T) {
+	tests := []struct {
+		name    string
+		stages  []stageConfig
+		wantErr bool
+	}{
+		{"empty", nil, true},
+		{"validate", []stageConfig{{Type: stageValidate, Require: []string{"$.id"}}}, false},
+		{"unknown type", []stageConfig{{Type: "filter"}}, true},
+		{"bad path", []stageConfig{{Type: stageValidate, Require: []string{"id"}}}, true},
+		{"negative max_bytes", []stageConfig{{Type: stageValidate, MaxBytes: -1}}, true},
+		{"remove array item", []stageConfig{{Type: stageTransform, Remove: []string{"$.a[0]"}}}, true},
+		{"publish without subject", []stageConfig{{Type: stagePublish}}, true},
+		{"publish bad subject", []stageConfig{{Type: stagePublish, Subject: "a.{b}"}}, true},
+		{"duplicate names", []stageConfig{{Type: stageValidate}, {Type: stageValidate}}, true},
+		{"named duplicates", []stageConfig{{Type: stageValidate}, {Name: "again", Type: stageValidate}}, false},
+		{"respond last", []stageConfig{{Type: stageValidate}, {Type: stageRespond}}, false},
+		{"respond not last", []stageConfig{{Type: stageRespond}, {Type: stageValidate}}, true},
+		{"bad status", []stageConfig{{Type: stageRespond, Status: 99}}, true},
+		{"bad body", []stageConfig{{Type: stageRespond, Body: "all"}}, true},
+	}
+	for _, tt := range tests {
+		if err := validatePipeline("p", tt.stages); (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPipelineHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		stages  []stageConfig
+		body    string
+		status  int
+		want    string
+		failed  string
+		skipped string
+	}{
+		{"no respond", []stageConfig{{Type: stageValidate}}, `{"a":1}`, http.StatusNoContent, "", "", ""},
+		{"respond message", []stageConfig{
+			{Type: stageTransform, Set: map[string]interface{}{"$.b": 2.0}, Remove: []string{"$.c"}},
+			{Type: stageRespond, Status: http.StatusCreated},
+		}, `{"a":1,"c":3}`, http.StatusCreated, `{"a":1,"b":2}`, "", ""},
+		{"respond none", []stageConfig{{Type: stageRespond, Body: "none"}}, `{}`, http.StatusOK, "", "", ""},
+		{"stages in order", []stageConfig{
+			{Name: "first", Type: stageTransform, Set: map[string]interface{}{"$.id": "x"}},
+			{Name: "second", Type: stageValidate, Require: []string{"$.id"}},
+			{Type: stageRespond},
+		}, `{}`, http.StatusOK, `{"id":"x"}`, "", ""},
+		{"validation failed", []stageConfig{
+			{Type: stageValidate, Require: []string{"$.id"}},
+			{Type: stageRespond},
+		}, `{"a":1}`, http.StatusUnprocessableEntity, `"code":"validation_failed"`, "validate", "respond"},
+		{"too large", []stageConfig{{Type: stageValidate, MaxBytes: 4}}, `{"a":1}`,
+			http.StatusRequestEntityTooLarge, `"code":"validation_failed"`, "validate", ""},
+		{"overlapping paths", []stageConfig{
+			{Type: stageTransform, Set: map[string]interface{}{
+				"$.meta.source": "gateway", "$.meta": map[string]interface{}{"v": 1.0}, "$.meta.v": 2.0,
+			}},
+			{Type: stageRespond},
+		}, `{}`, http.StatusOK, `{"meta":{"source":"gateway","v":2}}`, "", ""},
+		{"transform failed", []stageConfig{{Type: stageTransform, Set: map[string]interface{}{"$.a.b": 1.0}}}, `{"a":1}`,
+			http.StatusUnprocessableEntity, `"code":"transform_failed"`, "transform", ""},
+	}
+	for i, tt := range tests {
+		pipeline := "test" + string(rune('a'+i))
+		h := pipelineHandler(nil, routeConfig{Name: "r"}, pipeline, tt.stages)
+		// The metrics are global, so only their increments count
+		before := make(map[string]int64)
+		for _, st := range tt.stages {
+			for _, m := range []string{".calls", ".errors"} {
+				before[st.name()+m] = stageMetric(pipeline + "." + st.name() + m)
+			}
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/p", strings.NewReader(tt.body)))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, tt.want) || (tt.want == "" && body != "") {
+			t.Errorf("%s: body = %s, want %s", tt.name, body, tt.want)
+		}
+		for _, st := range tt.stages {
+			calls := stageMetric(pipeline+"."+st.name()+".calls") - before[st.name()+".calls"]
+			want := int64(1)
+			if st.name() == tt.skipped {
+				want = 0
+			}
+			if calls != want {
+				t.Errorf("%s: stage %s calls = %d, want %d", tt.name, st.name(), calls, want)
+			}
+			errs, want := stageMetric(pipeline+"."+st.name()+".errors")-before[st.name()+".errors"], int64(0)
+			if st.name() == tt.failed {
+				want = 1
+			}
+			if errs != want {
+				t.Errorf("%s: stage %s errors = %d, want %d", tt.name, st.name(), errs, want)
+			}
+		}
+	}
+}
+
+// stageMetric reads a counter of the pipeline metrics, zero if missing
+func stageMetric(key string) int64 {
+	if v, ok := pipelineMetrics.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSetJSON(t *testing.T) {
+	tests := []struct {
+		doc     string
+		path    string
+		value   interface{}
+		want    string
+		wantErr bool
+	}{
+		{`{"a": 1}`, "$.b", "x", `{"a":1,"b":"x"}`, false},
+		{`{"a": 1}`, "$.a", 2.0, `{"a":2}`, false},
+		{`{}`, "$.a.b.c", true, `{"a":{"b":{"c":true}}}`, false},
+		{`null`, "$.a", 1.0, `{"a":1}`, false},
+		{`{"a": 1}`, "$", "x", `"x"`, false},
+		{`{"a": [1, 2]}`, "$.a[1]", 3.0, `{"a":[1,3]}`, false},
+		{`{"a": [{"b": 1}]}`, "$.a[0].c", 2.0, `{"a":[{"b":1,"c":2}]}`, false},
+		{`{"a": [1]}`, "$.a[5]", 3.0, ``, true},
+		{`{"a": 1}`, "$.a.b", 3.0, ``, true},
+		{`[1]`, "$.a", 3.0, ``, true},
+		{`{}`, "a", 3.0, ``, true},
+	}
+	for _, tt := range tests {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		got, err := setJSON(doc, tt.path, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("setJSON(%s, %q) error = %v, want error %v", tt.doc, tt.path, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if data, _ := json.Marshal(got); string(data) != tt.want {
+			t.Errorf("setJSON(%s, %q) = %s, want %s", tt.doc, tt.path, data, tt.want)
+		}
+	}
+}
+
+func TestRemoveJSON(t *testing.T) {
+	tests := []struct {
+		doc     string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{`{"a": 1, "b": 2}`, "$.a", `{"b":2}`, false},
+		{`{"a": {"b": 1, "c": 2}}`, "$.a.b", `{"a":{"c":2}}`, false},
+		{`{"a": [{"b": 1}]}`, "$.a[0].b", `{"a":[{}]}`, false},
+		{`{"a": 1}`, "$.missing", `{"a":1}`, false},
+		{`{"a": 1}`, "$.x.y", `{"a":1}`, false},
+		{`{"a": [1]}`, "$.a[0]", ``, true},
+		{`{"a": 1}`, "$", ``, true},
+	}
+	for _, tt := range tests {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+			t.Fatal(err)
+		}
+		err := removeJSON(doc, tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("removeJSON(%s, %q) error = %v, want error %v", tt.doc, tt.path, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if data, _ := json.Marshal(doc); string(data) != tt.want {
+			t.Errorf("removeJSON(%s, %q) = %s, want %s", tt.doc, tt.path, data, tt.want)
+		}
+	}
+}
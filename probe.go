@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+)
+
+// ProbeHeader marks the interest probes sent to the route subject, so
+// responders can tell them apart from real requests. Responders must
+// not process them; they may reply with an empty message, or ignore them.
+const ProbeHeader = "Nats-Gw-Probe"
+
+// ServicePingPrefix is the subject prefix of the NATS micro PING
+// requests, answered by every instance of the service
+const ServicePingPrefix = "$SRV.PING."
+
+// ProbeTimeout is how long a probe waits for a reply. A responder that
+// does not answer probes delays the request by this much.
+const ProbeTimeout = 250 * time.Millisecond
+
+// probeCounts counts the probes sent, and those without responders
+var probeCounts = expvar.NewMap("probes")
+
+// probeInterest checks there are responders for the subject before the
+// body of a large request is read, and answers 503 right away when there
+// are none. Requests with a body of unknown size are always probed.
+func probeInterest(pub *nats.Conn, route routeConfig, next http.Handler) http.Handler {
+	if route.Probe <= 0 {
+		return next
+	}
+	subject, _ := parseSubject(route.Subject)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength >= 0 && r.ContentLength <= route.Probe {
+			next.ServeHTTP(w, r)
+			return
+		}
+		topic, err := subject.render(mux.Vars(r)["topic"], nil)
+		if err == nil && probe(r.Context(), pub, route.ProbeService, topic) == nats.ErrNoResponders {
+			// Do not wait for the client to upload the body
+			w.Header().Set("Connection", "close")
+			writeError(w, r, http.StatusServiceUnavailable, "no_responders", topic)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// probe pings the micro service, if any, or sends an empty request to
+// the subject otherwise. It only fails with nats.ErrNoResponders; a
+// probe without reply means there is a responder that ignores them.
+func probe(ctx context.Context, pub *nats.Conn, service, subject string) error {
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+	msg := nats.NewMsg(ServicePingPrefix + service)
+	if service == "" {
+		msg = nats.NewMsg(subject)
+		msg.Header.Set(ProbeHeader, "true")
+	}
+	probeCounts.Add("sent", 1)
+	_, err := pub.RequestMsgWithContext(ctx, msg)
+	if errors.Is(err, nats.ErrNoResponders) {
+		probeCounts.Add("no_responders", 1)
+		return nats.ErrNoResponders
+	}
+	return nil
+}
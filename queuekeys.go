@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// defaultTenant is the tenant of the clients without an API key, and
+// its key is used for the API keys without their own
+const defaultTenant = "*"
+
+// queueKeys are the AES-256 keys that encrypt the queued messages at
+// rest, by tenant (API key name)
+type queueKeys map[string]cipher.AEAD
+
+// loadQueueKeys reads a JSON file mapping each tenant to its base64
+// 32-byte key, such as the ones created by `openssl rand -base64 32`
+func loadQueueKeys(path string) (queueKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded map[string]string
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, fmt.Errorf("Error reading queue keys %s: %v", path, err)
+	}
+	keys := make(queueKeys, len(encoded))
+	for tenant, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("Queue key of %s must be 32 bytes in base64", tenant)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if keys[tenant], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// tenantOf is the tenant of a client by its API key name
+func tenantOf(keyName string) string {
+	if keyName == "" {
+		return defaultTenant
+	}
+	return keyName
+}
+
+// forTenant returns the key of the tenant, or the default one
+func (k queueKeys) forTenant(tenant string) (cipher.AEAD, error) {
+	if aead, ok := k[tenant]; ok {
+		return aead, nil
+	}
+	if aead, ok := k[defaultTenant]; ok {
+		return aead, nil
+	}
+	return nil, fmt.Errorf("No queue key for tenant %s", tenant)
+}
+
+// seal encrypts the data of the tenant, bound to the message ID. The
+// nonce is prepended to the result.
+func (k queueKeys) seal(tenant, id string, data []byte) ([]byte, error) {
+	aead, err := k.forTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, []byte(id)), nil
+}
+
+// open decrypts what seal encrypted
+func (k queueKeys) open(tenant, id string, sealed []byte) ([]byte, error) {
+	aead, err := k.forTenant(tenant)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Encrypted message too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(id))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueueKeys(t *testing.T) {
+	key := func(b byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(`{"*": "`+key(1)+`", "partner-a": "`+key(2)+`"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadQueueKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"id": 1}`)
+	for _, tenant := range []string{"partner-a", "partner-b", defaultTenant} {
+		sealed, err := keys.seal(tenant, "id1", data)
+		if err != nil {
+			t.Fatalf("seal for %s: %v", tenant, err)
+		}
+		if bytes.Contains(sealed, data) {
+			t.Errorf("seal for %s left the message in clear", tenant)
+		}
+		if opened, err := keys.open(tenant, "id1", sealed); err != nil || !bytes.Equal(opened, data) {
+			t.Errorf("open for %s = %s, %v", tenant, opened, err)
+		}
+		if _, err := keys.open(tenant, "id2", sealed); err == nil {
+			t.Errorf("open for %s with another ID succeeded", tenant)
+		}
+	}
+	sealed, _ := keys.seal("partner-a", "id1", data)
+	if _, err := keys.open("partner-b", "id1", sealed); err == nil {
+		t.Errorf("open with the key of another tenant succeeded")
+	}
+	delete(keys, defaultTenant)
+	if _, err := keys.seal("partner-b", "id1", data); err == nil {
+		t.Errorf("seal without a key for the tenant succeeded")
+	}
+	for _, bad := range []string{`{"*": "short"}`, `{"*": "` + key(1)[:10] + `"}`, `[]`} {
+		os.WriteFile(path, []byte(bad), 0600)
+		if _, err := loadQueueKeys(path); err == nil {
+			t.Errorf("loadQueueKeys(%s) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limitConfig allows a number of requests per client in each window
+type limitConfig struct {
+	Requests int      `json:"requests"`
+	Per      duration `json:"per"`
+}
+
+// validate checks the limit is either disabled or complete
+func (c *limitConfig) validate() error {
+	if c != nil && (c.Requests <= 0 || c.Per <= 0) {
+		return fmt.Errorf("needs positive requests and per, got %d per %s", c.Requests, time.Duration(c.Per))
+	}
+	return nil
+}
+
+// rateLimited counts the requests rejected by each route and kind of limit
+var rateLimited = expvar.NewMap("rate_limited")
+
+// rateLimitPrefix is the prefix of the rate limit counters in the store
+const rateLimitPrefix = "ratelimit."
+
+// limiter counts the requests of each client in fixed windows, aligned
+// to the clock. The counters are in the state store, so the gateways
+// sharing a NATS KV store share the limits.
+type limiter struct {
+	mu     sync.Mutex
+	name   string
+	cfg    limitConfig
+	store  store
+	window time.Time
+	// keys are the counters updated in the current window, deleted
+	// when it ends
+	keys map[string]bool
+}
+
+// limiters keeps the counters across config reloads, by route and kind
+var limiters = struct {
+	sync.Mutex
+	byName map[string]*limiter
+}{byName: make(map[string]*limiter)}
+
+// getLimiter returns the limiter for the route and kind, with the given
+// config. Counters are kept if the limit changes.
+func getLimiter(name string, cfg limitConfig, st store) *limiter {
+	limiters.Lock()
+	defer limiters.Unlock()
+	l, ok := limiters.byName[name]
+	if !ok {
+		l = &limiter{name: name, keys: make(map[string]bool)}
+		limiters.byName[name] = l
+	}
+	l.mu.Lock()
+	l.cfg, l.store = cfg, st
+	l.mu.Unlock()
+	return l
+}
+
+// take counts a request of the client, and returns the limit, the
+// requests left and when the window resets. ok is false if the client
+// has no requests left. Requests are allowed if the store fails.
+func (l *limiter) take(client string) (limit, remaining int, reset time.Time, ok bool) {
+	l.mu.Lock()
+	cfg, st := l.cfg, l.store
+	per := time.Duration(cfg.Per)
+	// The time is read under the lock, and the window only moves
+	// forward, so a late request never goes back to a past window
+	if window := time.Now().Truncate(per); window.After(l.window) {
+		go forgetCounters(st, l.keys)
+		l.window = window
+		l.keys = make(map[string]bool)
+	}
+	window := l.window
+	sum := sha256.Sum256([]byte(l.name + "\x00" + client))
+	key := rateLimitPrefix + hex.EncodeToString(sum[:16]) + "." + strconv.FormatInt(window.Unix(), 10)
+	l.keys[key] = true
+	l.mu.Unlock()
+	reset = window.Add(per)
+	count, err := st.Incr(key, 1)
+	if err != nil {
+		log.Print("Error counting request for rate limit: ", err)
+		rateLimited.Add("store_errors", 1)
+		return cfg.Requests, cfg.Requests, reset, true
+	}
+	if count > int64(cfg.Requests) {
+		return cfg.Requests, 0, reset, false
+	}
+	return cfg.Requests, cfg.Requests - int(count), reset, true
+}
+
+// forgetCounters deletes the counters of a past window
+func forgetCounters(st store, keys map[string]bool) {
+	for key := range keys {
+		if err := st.Delete(key); err != nil && err != errNotFound {
+			log.Print("Error deleting rate limit counter: ", err)
+		}
+	}
+}
+
+// rateLimit enforces the limit per client, and tells the usage in the
+// headers with the given prefix (e.g. "X-RateLimit"), also when the
+// request is allowed, so clients can slow down before being rejected.
+func rateLimit(st store, route, kind, prefix string, cfg *limitConfig, next http.Handler) http.Handler {
+	if cfg == nil {
+		return next
+	}
+	l := getLimiter(route+" "+kind, *cfg, st)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, remaining, reset, ok := l.take(clientID(r))
+		seconds := strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds())))
+		h := w.Header()
+		h.Set(prefix+"-Limit", strconv.Itoa(limit))
+		h.Set(prefix+"-Remaining", strconv.Itoa(remaining))
+		h.Set(prefix+"-Reset", seconds)
+		if !ok {
+			rateLimited.Add(route+" "+kind, 1)
+			h.Set("Retry-After", seconds)
+			writeError(w, r, http.StatusTooManyRequests, kind+"_exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientID identifies the client by its API key, or by its address
+func clientID(r *http.Request) string {
+	if name := apiKeyName(r); name != "" {
+		return "key " + name
+	}
+	return "ip " + clientIP(r)
+}
+
+// clientIP returns the address of the client, without the port
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readOnlyConfig enters read-only mode after repeated publish failures
+type readOnlyConfig struct {
+	// Failures within Window that trigger read-only mode, 0 to disable
+	Failures int      `json:"failures"`
+	Window   duration `json:"window"`
+	// Duration of the triggered read-only mode
+	Duration duration `json:"duration"`
+}
+
+// validate checks the config is either disabled or complete
+func (c readOnlyConfig) validate() error {
+	if c.Failures < 0 || (c.Failures > 0 && (c.Window <= 0 || c.Duration <= 0)) {
+		return fmt.Errorf("Invalid read_only config, needs failures, window and duration")
+	}
+	return nil
+}
+
+// readOnlyStatus is reported by /ready and the metrics
+type readOnlyStatus struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// readOnlyMode rejects the publish routes while enabled, manually or
+// triggered by failures, while requests and sessions keep working
+type readOnlyMode struct {
+	mu       sync.Mutex
+	cfg      readOnlyConfig
+	manual   bool
+	since    time.Time
+	until    time.Time
+	failures []time.Time
+}
+
+var readOnly = &readOnlyMode{}
+
+func init() {
+	expvar.Publish("read_only", expvar.Func(func() interface{} { return readOnly.status() }))
+}
+
+// update applies the config
+func (m *readOnlyMode) update(cfg readOnlyConfig) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cfg = cfg
+}
+
+// status tells whether the mode is enabled, why, and since when
+func (m *readOnlyMode) status() readOnlyStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	switch {
+	case m.manual:
+		since := m.since
+		return readOnlyStatus{Enabled: true, Reason: "manual", Since: &since}
+	case now.Before(m.until):
+		since, until := m.since, m.until
+		return readOnlyStatus{Enabled: true, Reason: "publish failures", Since: &since, Until: &until}
+	}
+	return readOnlyStatus{}
+}
+
+// active is true while publishes are rejected
+func (m *readOnlyMode) active() bool {
+	return m.status().Enabled
+}
+
+// setManual enables or disables the mode by hand. Disabling it also
+// ends the triggered mode.
+func (m *readOnlyMode) setManual(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.manual = enabled
+	m.until, m.failures = time.Time{}, nil
+	if enabled {
+		m.since = time.Now()
+	}
+}
+
+// failure records a failed publish, and enters the mode if there were
+// too many in the window. Only errors of NATS being unavailable or
+// timing out count, not denied or invalid publishes.
+func (m *readOnlyMode) failure(err error) {
+	if !classify(err).retryable() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cfg.Failures == 0 {
+		return
+	}
+	now := time.Now()
+	recent := m.failures[:0]
+	for _, t := range m.failures {
+		if now.Sub(t) < time.Duration(m.cfg.Window) {
+			recent = append(recent, t)
+		}
+	}
+	m.failures = append(recent, now)
+	if len(m.failures) >= m.cfg.Failures && !m.manual && !now.Before(m.until) {
+		m.since, m.until, m.failures = now, now.Add(time.Duration(m.cfg.Duration)), nil
+		log.Printf("ALERT read-only mode for %s after %d publish failures", time.Duration(m.cfg.Duration), m.cfg.Failures)
+	}
+}
+
+// readOnlyGate rejects the routes that publish while in read-only mode
+func readOnlyGate(action string, next http.Handler) http.Handler {
+	if action == "request" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if readOnly.active() {
+			writeError(w, r, http.StatusServiceUnavailable, "read_only")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setReadOnly enables or disables read-only mode from the admin API
+func (gw *gateway) setReadOnly(w http.ResponseWriter, r *http.Request) {
+	enabled := r.Method != "DELETE"
+	readOnly.setManual(enabled)
+	log.Printf("AUDIT read-only mode enabled: %t", enabled)
+	writeJSON(w, http.StatusOK, readOnly.status())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// WarmupTimeout is the timeout for each warm-up operation
+const WarmupTimeout = 4 * time.Second
+
+// ready is set to 1 once the gateway finishes warming up
+var ready int32
+
+func init() {
+	expvar.Publish("ready", expvar.Func(func() interface{} { return isReady() }))
+}
+
+func isReady() bool {
+	return atomic.LoadInt32(&ready) == 1
+}
+
+// warmUp makes sure the NATS connection is established, and sends a
+// request to each of the warm-up topics, before marking the gateway ready.
+// Failed warm-up requests are logged, but do not prevent readiness.
+func warmUp(nc *nats.Conn, topics []string) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), WarmupTimeout)
+	defer cancel()
+	if err := nc.FlushWithContext(ctx); err != nil {
+		return err
+	}
+	log.Printf("NATS connection established to %s, round trip %s", nc.ConnectedUrl(), time.Since(start))
+	for _, topic := range topics {
+		start = time.Now()
+		if err := warmUpRequest(nc, topic); err != nil {
+			log.Printf("Warm-up request to %s failed: %+v", topic, err)
+			continue
+		}
+		log.Printf("Warm-up request to %s answered in %s", topic, time.Since(start))
+	}
+	atomic.StoreInt32(&ready, 1)
+	log.Print("Gateway ready")
+	return nil
+}
+
+// warmUpRequest sends an empty JSON request to the topic
+func warmUpRequest(nc *nats.Conn, topic string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WarmupTimeout)
+	defer cancel()
+	_, err := nc.RequestWithContext(ctx, topic, []byte("{}"))
+	return err
+}
+
+// readyHandler answers 200 when the gateway is warmed up and the NATS
+// connection is established, 503 otherwise. The gateway is still ready
+// in read-only mode, since requests keep working.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	state := connection.current()
+	ok := isReady() && state == stateConnected
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, struct {
+		Ready    bool           `json:"ready"`
+		State    string         `json:"state"`
+		ReadOnly readOnlyStatus `json:"read_only"`
+	}{ok, state.String(), readOnly.status()})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MonitorInterval is the period between resource usage samples
+const MonitorInterval = 10 * time.Second
+
+// resourceLimits are soft limits on process resources. Zero disables the limit.
+type resourceLimits struct {
+	Goroutines int    `json:"goroutines"`
+	FDs        int    `json:"fds"`
+	HeapBytes  uint64 `json:"heap_bytes"`
+	// Shed rejects new requests and streaming sessions while any
+	// resource is above its limit
+	Shed bool `json:"shed,omitempty"`
+}
+
+// resourceUsage is a sample of process resources
+type resourceUsage struct {
+	Goroutines int    `json:"goroutines"`
+	FDs        int    `json:"fds"`
+	HeapBytes  uint64 `json:"heap_bytes"`
+}
+
+var (
+	resourceWarnings = expvar.NewMap("resource_warnings")
+	lastUsage        atomic.Value
+	// overLimits is set to 1 while any resource is above its soft limit
+	overLimits int32
+)
+
+func init() {
+	lastUsage.Store(resourceUsage{})
+	expvar.Publish("resources", expvar.Func(func() interface{} { return lastUsage.Load() }))
+}
+
+// underPressure is true while some resource is above its soft limit
+func underPressure() bool {
+	return atomic.LoadInt32(&overLimits) == 1
+}
+
+// shedLoad answers 503 while some resource is above its soft limit,
+// if shedding is enabled. Clients are told to retry after the next sample.
+func shedLoad(enabled bool, next http.Handler) http.Handler {
+	if !enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if underPressure() {
+			resourceWarnings.Add("shed", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(MonitorInterval/time.Second)))
+			writeError(w, r, http.StatusServiceUnavailable, "overloaded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sampleResources measures the current resource usage
+func sampleResources() resourceUsage {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return resourceUsage{
+		Goroutines: runtime.NumGoroutine(),
+		FDs:        openFDs(),
+		HeapBytes:  mem.HeapAlloc,
+	}
+}
+
+// openFDs counts the open file descriptors, or returns -1 if not supported
+func openFDs() int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// check logs a warning for each resource above its soft limit,
+// and returns true if any was found.
+func (l resourceLimits) check(u resourceUsage) bool {
+	over := false
+	if l.Goroutines > 0 && u.Goroutines > l.Goroutines {
+		log.Printf("WARNING: %d goroutines, over the soft limit of %d", u.Goroutines, l.Goroutines)
+		resourceWarnings.Add("goroutines", 1)
+		over = true
+	}
+	if l.FDs > 0 && u.FDs > l.FDs {
+		log.Printf("WARNING: %d open file descriptors, over the soft limit of %d", u.FDs, l.FDs)
+		resourceWarnings.Add("fds", 1)
+		over = true
+	}
+	if l.HeapBytes > 0 && u.HeapBytes > l.HeapBytes {
+		log.Printf("WARNING: %d bytes of heap in use, over the soft limit of %d", u.HeapBytes, l.HeapBytes)
+		resourceWarnings.Add("heap", 1)
+		over = true
+	}
+	return over
+}
+
+// monitorResources samples resource usage periodically, forever
+func monitorResources(limits func() resourceLimits) {
+	for range time.Tick(MonitorInterval) {
+		u := sampleResources()
+		lastUsage.Store(u)
+		var flag int32
+		if limits().check(u) {
+			flag = 1
+		}
+		atomic.StoreInt32(&overLimits, flag)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultReply is sent by the test responder when no fixture matches
+var defaultReply = []byte(`{ "fulfillmentText": "mensaje recibido", "payload": { "google": { "expectUserResponse": false } } }`)
+
+// fixture is a canned reply of the test responder
+type fixture struct {
+	// Subject the request is sent to, may include wildcards
+	Subject string `yaml:"subject"`
+	// When maps JSON paths of the request body to the values they must have
+	When map[string]interface{} `yaml:"when"`
+	// Reply is sent as is if it is a string, or encoded as JSON otherwise
+	Reply interface{} `yaml:"reply"`
+	// Latency is the wait before replying
+	Latency time.Duration `yaml:"latency"`
+
+	reply []byte
+}
+
+// loadFixtures reads a YAML file with a "fixtures" list
+func loadFixtures(path string) ([]fixture, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Fixtures []fixture `yaml:"fixtures"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+	for i := range file.Fixtures {
+		f := &file.Fixtures[i]
+		if f.Subject == "" {
+			return nil, fmt.Errorf("Fixture %d has no subject", i)
+		}
+		for path := range f.When {
+			if _, err := splitPath(path); err != nil {
+				return nil, fmt.Errorf("Fixture %d: %v", i, err)
+			}
+		}
+		if s, ok := f.Reply.(string); ok {
+			f.reply = []byte(s)
+		} else if f.reply, err = json.Marshal(f.Reply); err != nil {
+			return nil, fmt.Errorf("Fixture %d: %v", i, err)
+		}
+	}
+	return file.Fixtures, nil
+}
+
+// matches is true if the fixture applies to the message. body is the
+// decoded JSON body, or nil if it is not valid JSON.
+func (f fixture) matches(subject string, body interface{}) bool {
+	if !subjectMatches(f.Subject, subject) {
+		return false
+	}
+	for path, want := range f.When {
+		if body == nil {
+			return false
+		}
+		v, err := lookupJSON(body, path)
+		if err != nil {
+			return false
+		}
+		got, ok := scalarString(v)
+		if !ok || got != fmt.Sprint(want) {
+			return false
+		}
+	}
+	return true
+}
+
+// subjectMatches checks a subject against a pattern with * and > wildcards
+func subjectMatches(pattern, subject string) bool {
+	p := strings.Split(pattern, ".")
+	s := strings.Split(subject, ".")
+	for i, token := range p {
+		if token == ">" {
+			return len(s) > i
+		}
+		if i >= len(s) || (token != "*" && token != s[i]) {
+			return false
+		}
+	}
+	return len(p) == len(s)
+}
+
+// runResponder subscribes once to a subject covering the responder
+// subject and the subjects of the fixtures, and replies to requests with
+// the first matching fixture, so overlapping fixtures reply only once.
+// Requests to the responder subject that match no fixture get the
+// default reply.
+func runResponder(nc *nats.Conn, rc responderConfig) error {
+	var fixtures []fixture
+	if rc.Fixtures != "" {
+		var err error
+		if fixtures, err = loadFixtures(rc.Fixtures); err != nil {
+			return err
+		}
+		log.Printf("Loaded %d fixtures from %s", len(fixtures), rc.Fixtures)
+	}
+	var subjects []string
+	if rc.Subject != "" {
+		subjects = append(subjects, rc.Subject)
+	}
+	for _, f := range fixtures {
+		subjects = append(subjects, f.Subject)
+	}
+	respond := func(msg *nats.Msg) {
+		if !matchesAny(subjects, msg.Subject) {
+			return
+		}
+		data, err := payload(msg)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		log.Printf("Received message [%s] %s", msg.Subject, string(data))
+		if msg.Reply == "" {
+			return
+		}
+		if msg.Header.Get(ProbeHeader) != "" {
+			nc.Publish(msg.Reply, nil)
+			return
+		}
+		var body interface{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			body = nil
+		}
+		reply, latency := []byte(nil), time.Duration(0)
+		for _, f := range fixtures {
+			if f.matches(msg.Subject, body) {
+				reply, latency = f.reply, f.Latency
+				break
+			}
+		}
+		if reply == nil {
+			if rc.Subject == "" || !subjectMatches(rc.Subject, msg.Subject) {
+				log.Printf("No fixture matches message [%s]", msg.Subject)
+				return
+			}
+			reply = defaultReply
+		}
+		log.Printf("Message [%s] requested reply to %s", msg.Subject, msg.Reply)
+		go func() {
+			time.Sleep(latency)
+			if err := nc.Publish(msg.Reply, reply); err != nil {
+				log.Printf("Error replying to message [%s]: %+v", msg.Subject, err)
+			}
+		}()
+	}
+	subject := coveringSubject(subjects)
+	log.Printf("Running in test mode, subscribing to topic %s", subject)
+	s, err := nc.Subscribe(subject, respond)
+	if err != nil {
+		return err
+	}
+	defer s.Unsubscribe()
+	return waitForInterrupt()
+}
+
+// coveringSubject returns the subject that covers all the others, or
+// the ">" wildcard if none does
+func coveringSubject(subjects []string) string {
+	for _, candidate := range subjects {
+		covers := true
+		for _, s := range subjects {
+			if !patternCovers(candidate, s) {
+				covers = false
+				break
+			}
+		}
+		if covers {
+			return candidate
+		}
+	}
+	return ">"
+}
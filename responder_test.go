@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestCoveringSubject(t *testing.T) {
+	tests := []struct {
+		subjects []string
+		want     string
+	}{
+		{[]string{"orders.create"}, "orders.create"},
+		{[]string{"orders.create", "orders.>"}, "orders.>"},
+		{[]string{"orders.*", "orders.create"}, "orders.*"},
+		{[]string{"orders.create", "prices.get"}, ">"},
+		{[]string{"orders.*.eu", "orders.new.*"}, ">"},
+	}
+	for _, tt := range tests {
+		if got := coveringSubject(tt.subjects); got != tt.want {
+			t.Errorf("coveringSubject(%q) = %q, want %q", tt.subjects, got, tt.want)
+		}
+	}
+}
+
+func TestFixtureMatches(t *testing.T) {
+	f := fixture{Subject: "orders.>", When: map[string]interface{}{"$.type": "create", "$.qty": 2}}
+	tests := []struct {
+		subject string
+		body    interface{}
+		want    bool
+	}{
+		{"orders.eu", map[string]interface{}{"type": "create", "qty": 2.0}, true},
+		{"orders.eu", map[string]interface{}{"type": "delete", "qty": 2.0}, false},
+		{"orders.eu", map[string]interface{}{"type": "create"}, false},
+		{"orders.eu", nil, false},
+		{"prices.eu", map[string]interface{}{"type": "create", "qty": 2.0}, false},
+	}
+	for _, tt := range tests {
+		if got := f.matches(tt.subject, tt.body); got != tt.want {
+			t.Errorf("matches(%q, %v) = %v, want %v", tt.subject, tt.body, got, tt.want)
+		}
+	}
+}
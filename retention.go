@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// AdminTimeout bounds the NATS operations made by the admin API
+const AdminTimeout = 5 * time.Second
+
+// retentionInfo tells whether a subject is retained by a stream, and how
+type retentionInfo struct {
+	Subject  string           `json:"subject"`
+	Retained bool             `json:"retained"`
+	Stream   string           `json:"stream,omitempty"`
+	Limits   *retentionLimits `json:"limits,omitempty"`
+	// Messages stored for the subject filter
+	Messages uint64 `json:"messages"`
+	// Bytes is an estimate, from the average message size in the stream
+	Bytes uint64 `json:"bytes"`
+}
+
+// retentionLimits are the stream settings that decide how long data is kept
+type retentionLimits struct {
+	Retention         string   `json:"retention"`
+	Storage           string   `json:"storage"`
+	Discard           string   `json:"discard"`
+	MaxMsgs           int64    `json:"max_msgs"`
+	MaxBytes          int64    `json:"max_bytes"`
+	MaxAge            duration `json:"max_age"`
+	MaxMsgsPerSubject int64    `json:"max_msgs_per_subject"`
+}
+
+// retention reports which stream captures the subject in the query,
+// its retention limits, and how much data it holds for that subject.
+func (gw *gateway) retention(w http.ResponseWriter, r *http.Request) {
+	subject := r.URL.Query().Get("subject")
+	if subject == "" {
+		writeError(w, r, http.StatusBadRequest, "missing_subject")
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), AdminTimeout)
+	defer cancel()
+	info := retentionInfo{Subject: subject}
+	name, err := gw.js.StreamNameBySubject(ctx, subject)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		writeJSON(w, http.StatusOK, info)
+		return
+	}
+	if err != nil {
+		writeError(w, r, jsStatus(err), "jetstream_error", err)
+		return
+	}
+	stream, err := gw.js.Stream(ctx, name)
+	if err != nil {
+		writeError(w, r, jsStatus(err), "jetstream_error", err)
+		return
+	}
+	si, err := stream.Info(ctx, jetstream.WithSubjectFilter(subject))
+	if err != nil {
+		writeError(w, r, jsStatus(err), "jetstream_error", err)
+		return
+	}
+	info.Retained = true
+	info.Stream = name
+	info.Limits = &retentionLimits{
+		Retention:         si.Config.Retention.String(),
+		Storage:           si.Config.Storage.String(),
+		Discard:           si.Config.Discard.String(),
+		MaxMsgs:           si.Config.MaxMsgs,
+		MaxBytes:          si.Config.MaxBytes,
+		MaxAge:            duration(si.Config.MaxAge),
+		MaxMsgsPerSubject: si.Config.MaxMsgsPerSubject,
+	}
+	for _, count := range si.State.Subjects {
+		info.Messages += count
+	}
+	if si.State.Msgs > 0 {
+		info.Bytes = info.Messages * (si.State.Bytes / si.State.Msgs)
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// jsStatus maps JetStream API errors to HTTP status codes
+func jsStatus(err error) int {
+	var jsErr jetstream.JetStreamError
+	if errors.As(err, &jsErr) && jsErr.APIError() != nil && jsErr.APIError().Code != 0 {
+		return jsErr.APIError().Code
+	}
+	return natsStatus(err)
+}
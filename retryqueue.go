@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/nats-io/nats.go"
+)
+
+// RetryQueueInterval is the period between scans of the retry queue
+const RetryQueueInterval = 5 * time.Second
+
+// Backoff of the queued messages between attempts, doubling from
+// MinQueueBackoff up to MaxQueueBackoff
+const (
+	MinQueueBackoff = time.Second
+	MaxQueueBackoff = 5 * time.Minute
+)
+
+// retryPrefix is the prefix of the queued messages in the store
+const retryPrefix = "retry."
+
+// retryClaimPrefix is the prefix of the claims on the queued messages
+// being attempted, in the store
+const retryClaimPrefix = "retryclaim."
+
+// RetryClaimTTL is how long a claim on a queued message lasts, so the
+// messages claimed by a gateway that stopped are attempted again
+const RetryClaimTTL = time.Minute
+
+// retryQueueMetrics counts the messages queued, delivered and discarded,
+// and the failed attempts
+var retryQueueMetrics = expvar.NewMap("retry_queue")
+
+// queuedMessage is a publish that failed, waiting to be attempted again
+type queuedMessage struct {
+	ID          string    `json:"id"`
+	Route       string    `json:"route"`
+	Tenant      string    `json:"tenant"`
+	Subject     string    `json:"subject"`
+	Data        []byte    `json:"data"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
+	// Encrypted is true if Data is sealed with the key of the tenant
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// retryQueue keeps the failed publishes in the store, and publishes
+// them again until they are delivered or discarded. A message is
+// claimed in the store while being attempted, so the gateways sharing
+// the store don't attempt or discard it at the same time.
+type retryQueue struct {
+	nc    *nats.Conn
+	store store
+	// keys encrypt the queued messages, if set
+	keys queueKeys
+}
+
+// add queues a message of the tenant after the publish failed with
+// err. With queue keys, it is encrypted with the key of the tenant.
+func (q *retryQueue) add(route, tenant, subject string, data []byte, err error) (string, error) {
+	now := time.Now()
+	m := queuedMessage{
+		ID:          newRequestID(),
+		Route:       route,
+		Tenant:      tenant,
+		Subject:     subject,
+		Data:        data,
+		Queued:      now,
+		Attempts:    1,
+		NextAttempt: now.Add(MinQueueBackoff),
+		LastError:   err.Error(),
+	}
+	if q.keys != nil {
+		sealed, serr := q.keys.seal(tenant, m.ID, data)
+		if serr != nil {
+			return "", serr
+		}
+		m.Data, m.Encrypted = sealed, true
+	}
+	if err := q.save(m); err != nil {
+		return "", err
+	}
+	retryQueueMetrics.Add("queued", 1)
+	log.Printf("Queued message %s to %s for retry: %v", m.ID, subject, err)
+	return m.ID, nil
+}
+
+func (q *retryQueue) save(m queuedMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return q.store.Put(retryPrefix+m.ID, data)
+}
+
+func (q *retryQueue) load(id string) (queuedMessage, error) {
+	var m queuedMessage
+	data, err := q.store.Get(retryPrefix + id)
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+// list returns the queued messages, oldest first
+func (q *retryQueue) list() ([]queuedMessage, error) {
+	keys, err := q.store.Keys(retryPrefix)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]queuedMessage, 0, len(keys))
+	for _, key := range keys {
+		m, err := q.load(key[len(retryPrefix):])
+		if err == errNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Queued.Before(msgs[j].Queued) })
+	return msgs, nil
+}
+
+// attempt publishes the message, and removes it from the queue if it
+// is delivered, or schedules the next attempt otherwise
+func (q *retryQueue) attempt(m queuedMessage) error {
+	data := m.Data
+	if m.Encrypted {
+		var err error
+		if data, err = q.keys.open(m.Tenant, m.ID, m.Data); err != nil {
+			return fmt.Errorf("Error decrypting queued message %s: %v", m.ID, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDeadline)
+	defer cancel()
+	err := publishMsg(ctx, q.nc, &nats.Msg{Subject: m.Subject, Data: data})
+	if err == nil {
+		retryQueueMetrics.Add("delivered", 1)
+		log.Printf("Delivered queued message %s to %s after %d attempts", m.ID, m.Subject, m.Attempts+1)
+		return q.store.Delete(retryPrefix + m.ID)
+	}
+	retryQueueMetrics.Add("failed_attempts", 1)
+	backoff := MinQueueBackoff << uint(m.Attempts)
+	if backoff > MaxQueueBackoff || backoff <= 0 {
+		backoff = MaxQueueBackoff
+	}
+	m.Attempts++
+	m.NextAttempt = time.Now().Add(backoff)
+	m.LastError = err.Error()
+	if serr := q.save(m); serr != nil {
+		log.Printf("Error saving queued message %s: %v", m.ID, serr)
+	}
+	return err
+}
+
+// claim marks the message as being attempted until RetryClaimTTL, and
+// is false if it already is, by this or another gateway. Expired claims
+// are taken over.
+func (q *retryQueue) claim(id string) (bool, error) {
+	key := retryClaimPrefix + id
+	until := []byte(time.Now().Add(RetryClaimTTL).Format(time.RFC3339Nano))
+	err := q.store.Swap(key, nil, until)
+	if err != errChanged {
+		return err == nil, err
+	}
+	old, err := q.store.Get(key)
+	if err == errNotFound {
+		// The claim just ended
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if expiry, perr := time.Parse(time.RFC3339Nano, string(old)); perr == nil && expiry.After(time.Now()) {
+		return false, nil
+	}
+	err = q.store.Swap(key, old, until)
+	if err == errChanged {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unclaim ends the attempt of the message
+func (q *retryQueue) unclaim(id string) {
+	if err := q.store.Delete(retryClaimPrefix + id); err != nil && err != errNotFound {
+		log.Printf("Error releasing queued message %s: %v", id, err)
+	}
+}
+
+// retryDue attempts the messages whose next attempt is due, and that no
+// other gateway is attempting. Each message is loaded again once
+// claimed, in case another gateway delivered or attempted it meanwhile.
+func (q *retryQueue) retryDue() {
+	msgs, err := q.list()
+	if err != nil {
+		log.Print("Error listing the retry queue: ", err)
+		return
+	}
+	for _, m := range msgs {
+		if m.NextAttempt.After(time.Now()) {
+			continue
+		}
+		id := m.ID
+		claimed, err := q.claim(id)
+		if err != nil {
+			log.Printf("Error claiming queued message %s: %v", id, err)
+		}
+		if !claimed {
+			continue
+		}
+		if m, err = q.load(id); err == nil && !m.NextAttempt.After(time.Now()) {
+			if err := q.attempt(m); err != nil {
+				log.Printf("Queued message %s to %s failed again: %v", m.ID, m.Subject, err)
+			}
+		} else if err != nil && err != errNotFound {
+			log.Printf("Error loading queued message %s: %v", id, err)
+		}
+		q.unclaim(id)
+	}
+}
+
+// run retries the due messages every RetryQueueInterval
+func (q *retryQueue) run() {
+	for range time.Tick(RetryQueueInterval) {
+		q.retryDue()
+	}
+}
+
+// retryList lists the queued messages in the admin API
+func (gw *gateway) retryList(w http.ResponseWriter, r *http.Request) {
+	msgs, err := gw.queue.list()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+// claimed claims the queued message for an admin request, and loads
+// it. It answers the request and returns false if it fails.
+func (gw *gateway) claimed(w http.ResponseWriter, r *http.Request, id string) (queuedMessage, bool) {
+	ok, err := gw.queue.claim(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+		return queuedMessage{}, false
+	}
+	if !ok {
+		writeError(w, r, http.StatusConflict, "retry_in_progress", id)
+		return queuedMessage{}, false
+	}
+	m, err := gw.queue.load(id)
+	if err == errNotFound {
+		gw.queue.unclaim(id)
+		writeError(w, r, http.StatusNotFound, "unknown_message", id)
+		return m, false
+	}
+	if err != nil {
+		gw.queue.unclaim(id)
+		writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+		return m, false
+	}
+	return m, true
+}
+
+// retryNow attempts a queued message right away
+func (gw *gateway) retryNow(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	m, ok := gw.claimed(w, r, id)
+	if !ok {
+		return
+	}
+	err := gw.queue.attempt(m)
+	gw.queue.unclaim(id)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, natsCode(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// retryDiscard drops a queued message
+func (gw *gateway) retryDiscard(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	m, ok := gw.claimed(w, r, id)
+	if !ok {
+		return
+	}
+	err := gw.queue.store.Delete(retryPrefix + id)
+	gw.queue.unclaim(id)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "internal_error", err)
+		return
+	}
+	retryQueueMetrics.Add("discarded", 1)
+	log.Printf("AUDIT retry queue: discarded message %s to %s, %d bytes, after %d attempts", m.ID, m.Subject, len(m.Data), m.Attempts)
+	w.WriteHeader(http.StatusNoContent)
+}
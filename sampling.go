@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// sampled counts the messages kept and dropped by sampling, by route
+var sampled = expvar.NewMap("sampling")
+
+// SampledHeader tells the client its message was dropped by sampling,
+// with the value "dropped"
+const SampledHeader = "X-Sampled"
+
+// samplingConfig keeps a share of the messages of a publish route
+type samplingConfig struct {
+	// OneIn keeps one message in N
+	OneIn int `json:"one_in"`
+	// Key is a JSON path of the body. If set, one key in N is kept,
+	// with all its messages, instead of one message in N.
+	Key string `json:"key,omitempty"`
+}
+
+// validate checks the config is complete
+func (c *samplingConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.OneIn < 1 {
+		return fmt.Errorf("needs one_in of at least 1, got %d", c.OneIn)
+	}
+	if c.Key != "" {
+		if _, err := splitPath(c.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampler decides which messages of a route are kept
+type sampler struct {
+	count uint64 // first, for 64-bit alignment
+	route string
+	cfg   samplingConfig
+}
+
+func newSampler(route string, cfg *samplingConfig) *sampler {
+	if cfg == nil {
+		return nil
+	}
+	return &sampler{route: route, cfg: *cfg}
+}
+
+// keep is true if the message is sampled in. Messages without the key
+// are always kept.
+func (s *sampler) keep(data []byte) bool {
+	if s == nil {
+		return true
+	}
+	keep := true
+	if s.cfg.Key == "" {
+		keep = atomic.AddUint64(&s.count, 1)%uint64(s.cfg.OneIn) == 0
+	} else if key, ok := sampleKey(data, s.cfg.Key); ok {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		keep = h.Sum32()%uint32(s.cfg.OneIn) == 0
+	}
+	if keep {
+		sampled.Add(s.route+" kept", 1)
+	} else {
+		sampled.Add(s.route+" dropped", 1)
+	}
+	return keep
+}
+
+// sampleKey returns the value at the path of the JSON body
+func sampleKey(data []byte, path string) (string, bool) {
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return "", false
+	}
+	v, err := lookupJSON(body, path)
+	if err != nil {
+		return "", false
+	}
+	return scalarString(v)
+}
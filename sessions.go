@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SessionHeader identifies the streaming session that gets the reply
+// of a publish_reply route
+const SessionHeader = "X-Session-Id"
+
+// SessionBuffer is the number of replies queued for a slow client,
+// replies beyond that are dropped
+const SessionBuffer = 64
+
+// SessionKeepAlive is the interval of the keep-alive comments sent to
+// idle streams, so proxies do not close them
+const SessionKeepAlive = 15 * time.Second
+
+// sessionMetrics counts the open sessions, and the replies delivered
+// and dropped
+var sessionMetrics = expvar.NewMap("sessions")
+
+// session is an event stream that receives the replies to the
+// messages published for it, and the messages on the subjects it
+// subscribed to
+type session struct {
+	id       string
+	key      string
+	inbox    string
+	subjects []string
+	subs     []*nats.Subscription
+	replies  chan *nats.Msg
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// sessionsConfig sets who can open streaming sessions, and how many
+type sessionsConfig struct {
+	// Auth scheme of GET /sessions: none (default), apikey or mtls
+	Auth string `json:"auth,omitempty"`
+	// Subjects clients may subscribe to, may include wildcards
+	Subjects []string `json:"subjects,omitempty"`
+	// Quotas by API key name. "*" applies to each key without its own,
+	// and to the anonymous sessions as a whole.
+	Quotas map[string]streamQuota `json:"quotas,omitempty"`
+}
+
+// streamQuota limits the concurrent sessions of an API key, and the
+// subjects subscribed by all of them. Zero is unlimited.
+type streamQuota struct {
+	Sessions int `json:"sessions"`
+	Subjects int `json:"subjects"`
+}
+
+// quota returns the quota of the API key
+func (c sessionsConfig) quota(key string) streamQuota {
+	if q, ok := c.Quotas[key]; ok && key != "" {
+		return q
+	}
+	return c.Quotas["*"]
+}
+
+// validate checks the auth scheme and subjects
+func (c sessionsConfig) validate(keys map[string]string) error {
+	switch c.Auth {
+	case "", authNone, authMTLS:
+	case authAPIKey:
+		if len(keys) == 0 {
+			return errors.New("Sessions require an API key, but there are none")
+		}
+	default:
+		return fmt.Errorf("Sessions have unknown auth %q", c.Auth)
+	}
+	for _, s := range c.Subjects {
+		if !validPattern(s) {
+			return fmt.Errorf("Invalid session subject %q", s)
+		}
+	}
+	for name, q := range c.Quotas {
+		if q.Sessions < 0 || q.Subjects < 0 {
+			return fmt.Errorf("Negative session quota for %s", name)
+		}
+	}
+	return nil
+}
+
+// keyUsage counts the sessions and subjects of an API key
+type keyUsage struct {
+	Sessions int `json:"sessions"`
+	Subjects int `json:"subjects"`
+}
+
+// Errors opening sessions beyond the quota
+var (
+	errSessionQuota = errors.New("Too many sessions")
+	errSubjectQuota = errors.New("Too many subjects")
+)
+
+// sessionRegistry keeps the open sessions, and their usage by API key
+type sessionRegistry struct {
+	mu    sync.Mutex
+	byID  map[string]*session
+	usage map[string]*keyUsage
+}
+
+var sessions = &sessionRegistry{byID: make(map[string]*session), usage: make(map[string]*keyUsage)}
+
+// open creates a session for the API key, subscribed to a new inbox
+// and to the subjects, if the quota allows it
+func (reg *sessionRegistry) open(nc *nats.Conn, key string, subjects []string, quota streamQuota) (*session, error) {
+	s := &session{
+		id:       newRequestID() + newRequestID(),
+		key:      key,
+		inbox:    nc.NewInbox(),
+		subjects: subjects,
+		replies:  make(chan *nats.Msg, SessionBuffer),
+		closed:   make(chan struct{}),
+	}
+	reg.mu.Lock()
+	u, ok := reg.usage[key]
+	if !ok {
+		u = &keyUsage{}
+		reg.usage[key] = u
+	}
+	if quota.Sessions > 0 && u.Sessions >= quota.Sessions {
+		reg.mu.Unlock()
+		return nil, errSessionQuota
+	}
+	if quota.Subjects > 0 && u.Subjects+len(subjects) > quota.Subjects {
+		reg.mu.Unlock()
+		return nil, errSubjectQuota
+	}
+	u.Sessions++
+	u.Subjects += len(subjects)
+	reg.byID[s.id] = s
+	reg.mu.Unlock()
+	sessionMetrics.Add("open", 1)
+	deliver := func(msg *nats.Msg) {
+		select {
+		case s.replies <- msg:
+		default:
+			sessionMetrics.Add("dropped", 1)
+		}
+	}
+	for _, subject := range append([]string{s.inbox + ".*"}, subjects...) {
+		sub, err := nc.Subscribe(subject, deliver)
+		if err != nil {
+			reg.close(s)
+			return nil, err
+		}
+		s.subs = append(s.subs, sub)
+	}
+	return s, nil
+}
+
+// get returns the session with the given ID, or nil
+func (reg *sessionRegistry) get(id string) *session {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.byID[id]
+}
+
+// close ends the session
+func (reg *sessionRegistry) close(s *session) {
+	s.once.Do(func() {
+		for _, sub := range s.subs {
+			sub.Unsubscribe()
+		}
+		reg.mu.Lock()
+		delete(reg.byID, s.id)
+		if u := reg.usage[s.key]; u != nil {
+			u.Sessions--
+			u.Subjects -= len(s.subjects)
+			if u.Sessions == 0 {
+				delete(reg.usage, s.key)
+			}
+		}
+		reg.mu.Unlock()
+		sessionMetrics.Add("open", -1)
+		close(s.closed)
+	})
+}
+
+// total adds up the sessions and subjects of all the API keys
+func (reg *sessionRegistry) total() keyUsage {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	var total keyUsage
+	for _, u := range reg.usage {
+		total.Sessions += u.Sessions
+		total.Subjects += u.Subjects
+	}
+	return total
+}
+
+// closeAll ends all the sessions, so the server can shut down
+func (reg *sessionRegistry) closeAll() {
+	reg.mu.Lock()
+	all := make([]*session, 0, len(reg.byID))
+	for _, s := range reg.byID {
+		all = append(all, s)
+	}
+	reg.mu.Unlock()
+	for _, s := range all {
+		reg.close(s)
+	}
+}
+
+// streamHandler opens a session, subscribed to the subjects in the
+// "subscribe" query parameters, and sends the replies and messages
+// received for it as server-sent events. The first event tells the
+// session ID.
+func streamHandler(nc *nats.Conn, cfg sessionsConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, r, http.StatusInternalServerError, "streaming_unsupported")
+			return
+		}
+		subjects := r.URL.Query()["subscribe"]
+		for _, subject := range subjects {
+			if !validPattern(subject) || !coveredByAny(cfg.Subjects, subject) {
+				writeError(w, r, http.StatusForbidden, "subject_not_allowed", subject)
+				return
+			}
+		}
+		key := apiKeyName(r)
+		s, err := sessions.open(nc, key, subjects, cfg.quota(key))
+		switch err {
+		case nil:
+		case errSessionQuota:
+			writeError(w, r, http.StatusTooManyRequests, "session_quota_exceeded")
+			return
+		case errSubjectQuota:
+			writeError(w, r, http.StatusTooManyRequests, "subject_quota_exceeded")
+			return
+		default:
+			writeError(w, r, natsStatus(err), natsCode(err), err)
+			return
+		}
+		defer sessions.close(s)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		writeEvent(w, "session", "", []byte(s.id))
+		flusher.Flush()
+		keepAlive := time.NewTicker(SessionKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-s.closed:
+				return
+			case <-keepAlive.C:
+				fmt.Fprint(w, ":\n\n")
+			case msg := <-s.replies:
+				data, err := payload(msg)
+				if err != nil {
+					log.Print(err)
+					sessionMetrics.Add("dropped", 1)
+					continue
+				}
+				if strings.HasPrefix(msg.Subject, s.inbox+".") {
+					sessionMetrics.Add("replies", 1)
+					writeEvent(w, "reply", msg.Subject[len(s.inbox)+1:], data)
+				} else {
+					sessionMetrics.Add("messages", 1)
+					event, _ := json.Marshal(struct {
+						Subject string `json:"subject"`
+						Data    string `json:"data"`
+					}{msg.Subject, string(data)})
+					writeEvent(w, "message", "", event)
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+// sessionUsage reports the sessions and subjects of each API key, and
+// their quotas, in the admin API
+func (gw *gateway) sessionUsage(w http.ResponseWriter, r *http.Request) {
+	cfg := gw.current().Sessions
+	type usage struct {
+		keyUsage
+		Quota streamQuota `json:"quota"`
+	}
+	sessions.mu.Lock()
+	result := make(map[string]usage, len(sessions.usage))
+	for key, u := range sessions.usage {
+		name := key
+		if name == "" {
+			name = "(anonymous)"
+		}
+		result[name] = usage{*u, cfg.quota(key)}
+	}
+	sessions.mu.Unlock()
+	writeJSON(w, http.StatusOK, result)
+}
+
+// writeEvent writes a server-sent event, one data line per line of data
+func writeEvent(w http.ResponseWriter, event, id string, data []byte) {
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// withSession finds the session in the SessionHeader, for the
+// publish_reply action
+func withSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(SessionHeader)
+		if id == "" {
+			writeError(w, r, http.StatusBadRequest, "missing_session", SessionHeader)
+			return
+		}
+		// Sessions of other API keys are unknown to the client, so their
+		// IDs cannot be probed
+		s := sessions.get(id)
+		if s == nil || s.key != apiKeyName(r) {
+			writeError(w, r, http.StatusNotFound, "unknown_session", id)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionKey, s)))
+	})
+}
+
+// publishReply publishes the message with a reply subject of the
+// session, and answers with the ID the reply will have in the stream
+func publishReply(ctx context.Context, pub *nats.Conn, topic string, data []byte) (response []byte, status int, err error) {
+	s, ok := ctx.Value(sessionKey).(*session)
+	if !ok {
+		log.Print("publish_reply action without session")
+		return nil, http.StatusInternalServerError, fmt.Errorf("No session for %s", topic)
+	}
+	id := newRequestID()
+	msg := newMsg(ctx, topic, data)
+	msg.Reply = s.inbox + "." + id
+	if err := publishMsg(ctx, pub, msg); err != nil {
+		return nil, natsStatus(err), err
+	}
+	return []byte(fmt.Sprintf(`{"reply_id":%q}`, id)), http.StatusAccepted, nil
+}
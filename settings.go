@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// settings are the parts of the configuration that can be reloaded
+// from the config file, without restarting the gateway.
+type settings struct {
+	// NATS connection settings, only applied on startup
+	NATS natsConfig `json:"nats"`
+	// Responder subscribes and replies to a subject, for testing
+	Responder responderConfig `json:"responder"`
+	Routes    []routeConfig   `json:"routes"`
+	// Taps are subject patterns to count messages and bytes on
+	Taps []string `json:"taps"`
+	// States sets the behavior of the routes (buffer, reject or degrade)
+	// while the NATS connection is connecting, reconnecting or draining
+	States map[string]string `json:"states"`
+	Limits resourceLimits    `json:"limits"`
+	// Canary is the percentage of traffic sent to these settings when
+	// reloaded. 0 or 100 apply them to all the traffic.
+	Canary int `json:"canary_percent"`
+	// Store keeps the gateway state, only applied on startup
+	Store storeConfig `json:"store"`
+	// Journal keeps the replies of request routes by idempotency key,
+	// only applied on startup
+	Journal journalConfig `json:"journal"`
+	// APIKeys maps the name of each client to its API key, for the
+	// routes with apikey auth
+	APIKeys map[string]string `json:"api_keys"`
+	// SmokeTests run on startup, before the gateway is ready
+	SmokeTests []smokeTest `json:"smoke_tests"`
+	// ReadOnly enters read-only mode after repeated publish failures
+	ReadOnly readOnlyConfig `json:"read_only"`
+	// Breaker is the circuit breaker of the routes without their own
+	Breaker *breakerConfig `json:"breaker,omitempty"`
+	// Sessions sets who can open streaming sessions, and how many
+	Sessions sessionsConfig `json:"sessions"`
+	// SchemaDrift profiles the payloads of some subjects, and alerts
+	// when they change shape
+	SchemaDrift driftConfig `json:"schema_drift"`
+	// Pipelines are named lists of stages, run by the routes with the
+	// pipeline action
+	Pipelines map[string][]stageConfig `json:"pipelines"`
+	// Messages adds languages or replaces messages of the error
+	// catalog, by language and error code
+	Messages map[string]map[string]string `json:"messages"`
+}
+
+// natsConfig describes the connection to the NATS server
+type natsConfig struct {
+	// URL of the server, or comma-separated list of URLs
+	URL  string `json:"url"`
+	User string `json:"user,omitempty"`
+	Pass string `json:"pass,omitempty"`
+	// JetStream domain, or custom API prefix, to reach a hub JetStream
+	// deployment through a leafnode
+	JSDomain    string `json:"js_domain,omitempty"`
+	JSAPIPrefix string `json:"js_api_prefix,omitempty"`
+	// InboxPrefix replaces _INBOX in the reply subjects, for users only
+	// allowed to subscribe to their own inboxes
+	InboxPrefix string `json:"inbox_prefix,omitempty"`
+	// NoEcho does not deliver the messages published by the gateway
+	// back to its own subscriptions
+	NoEcho bool `json:"no_echo,omitempty"`
+}
+
+// redactedValue replaces secrets in logs and exports
+const redactedValue = "********"
+
+// redacted hides the password
+func (n natsConfig) redacted() natsConfig {
+	if n.Pass != "" {
+		n.Pass = redactedValue
+	}
+	return n
+}
+
+// responderConfig describes the test mode responder
+type responderConfig struct {
+	// Subject to subscribe to. The gateway does not serve HTTP if set.
+	Subject string `json:"subject,omitempty"`
+	// Fixtures is a YAML file with canned replies, see loadFixtures
+	Fixtures string `json:"fixtures,omitempty"`
+}
+
+// routeConfig describes a gateway route
+type routeConfig struct {
+	// Name identifies the route in logs and config diffs
+	Name string `json:"name"`
+	// Path of the route, may include a {topic} variable
+	Path string `json:"path"`
+	// Subject template to publish to, see parseSubject
+	Subject string `json:"subject"`
+	// Action is "publish", "request", "publish_reply" to send the
+	// reply to a streaming session, or "pipeline"
+	Action string `json:"action"`
+	// Pipeline run by the route, for the pipeline action
+	Pipeline string `json:"pipeline,omitempty"`
+	// Timeout is the overall handler timeout
+	Timeout duration `json:"timeout"`
+	// Deadline is the default deadline for NATS operations
+	Deadline duration `json:"deadline"`
+	// Retries is the number of times a NATS operation is retried
+	// after a retryable error, within the deadline
+	Retries int `json:"retries"`
+	// Auth is the authentication scheme: none (default), apikey or mtls
+	Auth string `json:"auth,omitempty"`
+	// Probe checks there are responders before reading request bodies
+	// larger than this many bytes, 0 to disable
+	Probe int64 `json:"probe_bytes,omitempty"`
+	// ProbeService is the name of the NATS micro service that serves
+	// the subject. If set, probes ping the service instead of sending
+	// an empty request to the subject.
+	ProbeService string `json:"probe_service,omitempty"`
+	// RateLimit and Quota limit the requests of each client, by API
+	// key or address. They only differ in the response headers.
+	RateLimit *limitConfig `json:"rate_limit,omitempty"`
+	Quota     *limitConfig `json:"quota,omitempty"`
+	// Sampling drops part of the messages of a publish route
+	Sampling *samplingConfig `json:"sampling,omitempty"`
+	// RetryQueue keeps the publishes that fail after the retries, and
+	// publishes them again later, instead of answering an error
+	RetryQueue bool `json:"retry_queue,omitempty"`
+	// Journal replays the reply of a request route to the retries with
+	// the same idempotency key
+	Journal bool `json:"journal,omitempty"`
+	// Idempotent tells the responders of a request route can handle the
+	// same request twice, so it is retried after timeouts
+	Idempotent bool `json:"idempotent,omitempty"`
+	// Breaker fails fast while NATS keeps failing, the breaker of the
+	// settings by default
+	Breaker *breakerConfig `json:"breaker,omitempty"`
+	// JetStream publishes through JetStream, waiting for the stream to
+	// store the message, and Compress compresses the large payloads
+	JetStream bool            `json:"jetstream,omitempty"`
+	Compress  *compressConfig `json:"compress,omitempty"`
+}
+
+// retriesTimeouts is true if the NATS operations of the route can be
+// attempted again after a timeout. A request that timed out may have
+// been handled, so it is only retried if the route is idempotent or
+// journaled.
+func (r routeConfig) retriesTimeouts(action string) bool {
+	return action != "request" || r.Idempotent || r.Journal
+}
+
+// duration is a time.Duration that reads and writes as a JSON string
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// DefaultDeadline is the default deadline for NATS operations in a route
+const DefaultDeadline = 4 * time.Second
+
+// actions maps route action names to their implementation
+var actions = map[string]action{
+	"publish":       topic,
+	"request":       request,
+	"publish_reply": publishReply,
+}
+
+// defaultSettings builds the settings from the command line flags
+func defaultSettings(cfg config) settings {
+	return settings{
+		Routes: []routeConfig{
+			{Name: "topics", Path: "/topics/{topic}", Subject: DefaultSubject, Action: "publish", Timeout: duration(cfg.TopicsTimeout), Deadline: duration(DefaultDeadline)},
+			{Name: "requests", Path: "/requests/{topic}", Subject: DefaultSubject, Action: "request", Timeout: duration(cfg.RequestsTimeout), Deadline: duration(DefaultDeadline)},
+		},
+		Limits: cfg.Limits,
+	}
+}
+
+// loadSettings reads the config file, if any, on top of the defaults,
+// and fills in the connection settings from the legacy flags.
+func loadSettings(cfg config) (settings, error) {
+	if cfg.File == "" {
+		return parseSettings(cfg, nil)
+	}
+	data, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return settings{}, err
+	}
+	s, err := parseSettings(cfg, data)
+	if err != nil {
+		return s, fmt.Errorf("Error in %s: %v", cfg.File, err)
+	}
+	return s, nil
+}
+
+// parseSettings reads a settings document, if any, and fills in the
+// defaults. The default routes are only used if the document has none.
+// Decoding on top of them would mix their fields into the routes of the
+// document.
+func parseSettings(cfg config, data []byte) (settings, error) {
+	var s settings
+	if data != nil {
+		if err := json.Unmarshal(data, &s); err != nil {
+			return s, err
+		}
+	}
+	defaults := defaultSettings(cfg)
+	if s.Routes == nil {
+		s.Routes = defaults.Routes
+	}
+	if s.Limits.Goroutines == 0 {
+		s.Limits.Goroutines = defaults.Limits.Goroutines
+	}
+	if s.Limits.FDs == 0 {
+		s.Limits.FDs = defaults.Limits.FDs
+	}
+	if s.Limits.HeapBytes == 0 {
+		s.Limits.HeapBytes = defaults.Limits.HeapBytes
+	}
+	cfg.migrate(&s)
+	for i := range s.Routes {
+		if s.Routes[i].Timeout == 0 {
+			s.Routes[i].Timeout = duration(cfg.TopicsTimeout)
+			if s.Routes[i].Action == "request" {
+				s.Routes[i].Timeout = duration(cfg.RequestsTimeout)
+			}
+		}
+		if s.Routes[i].Deadline <= 0 {
+			s.Routes[i].Deadline = duration(DefaultDeadline)
+		}
+		if s.Routes[i].Breaker == nil {
+			s.Routes[i].Breaker = s.Breaker
+		}
+		if s.Routes[i].Subject == "" {
+			s.Routes[i].Subject = DefaultSubject
+		}
+		if s.Routes[i].Auth == "" {
+			s.Routes[i].Auth = authNone
+		}
+	}
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+	for _, r := range s.Routes {
+		if r.Auth == authMTLS && cfg.TLSClientCA == "" {
+			return s, fmt.Errorf("Route %s requires mtls, set -tls-client-ca", r.Name)
+		}
+	}
+	return s, nil
+}
+
+// validate checks the settings are consistent
+func (s settings) validate() error {
+	if s.NATS.URL == "" {
+		return errors.New("Missing NATS server, set nats.url in the config file")
+	}
+	if err := s.Store.validate(); err != nil {
+		return err
+	}
+	if err := s.Journal.validate(); err != nil {
+		return err
+	}
+	if s.NATS.JSDomain != "" && s.NATS.JSAPIPrefix != "" {
+		return errors.New("Set either nats.js_domain or nats.js_api_prefix, not both")
+	}
+	if s.NATS.JSDomain != "" && !validToken(s.NATS.JSDomain) {
+		return fmt.Errorf("Invalid JetStream domain %q", s.NATS.JSDomain)
+	}
+	if s.NATS.JSAPIPrefix != "" && !validJSPrefix(s.NATS.JSAPIPrefix) {
+		return fmt.Errorf("Invalid JetStream API prefix %q", s.NATS.JSAPIPrefix)
+	}
+	if s.NATS.InboxPrefix != "" && !validSubject(s.NATS.InboxPrefix) {
+		return fmt.Errorf("Invalid inbox prefix %q", s.NATS.InboxPrefix)
+	}
+	if s.Canary < 0 || s.Canary > 100 {
+		return fmt.Errorf("Invalid canary percentage %d", s.Canary)
+	}
+	for state, behavior := range s.States {
+		if _, ok := defaultBehaviors[state]; !ok {
+			return fmt.Errorf("Unknown connection state %q", state)
+		}
+		switch behavior {
+		case behaviorBuffer, behaviorReject, behaviorDegrade:
+		default:
+			return fmt.Errorf("Unknown behavior %q for state %s", behavior, state)
+		}
+	}
+	names := make(map[string]bool)
+	for _, r := range s.Routes {
+		if r.Name == "" {
+			return errors.New("Route without name")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("Duplicate route %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Path == "" {
+			return fmt.Errorf("Route %s has no path", r.Name)
+		}
+		if r.Action == "pipeline" {
+			if _, ok := s.Pipelines[r.Pipeline]; !ok {
+				return fmt.Errorf("Route %s has unknown pipeline %q", r.Name, r.Pipeline)
+			}
+		} else if _, ok := actions[r.Action]; !ok {
+			return fmt.Errorf("Route %s has unknown action %q", r.Name, r.Action)
+		} else if r.Pipeline != "" {
+			return fmt.Errorf("Route %s: only pipeline routes can have a pipeline", r.Name)
+		}
+		subject, err := parseSubject(r.Subject)
+		if err != nil {
+			return fmt.Errorf("Route %s: %v", r.Name, err)
+		}
+		if err := r.RateLimit.validate(); err != nil {
+			return fmt.Errorf("Route %s rate_limit %v", r.Name, err)
+		}
+		if err := r.Quota.validate(); err != nil {
+			return fmt.Errorf("Route %s quota %v", r.Name, err)
+		}
+		if err := r.Sampling.validate(); err != nil {
+			return fmt.Errorf("Route %s sampling %v", r.Name, err)
+		}
+		if r.Sampling != nil && r.Action != "publish" {
+			return fmt.Errorf("Route %s: only publish routes can be sampled", r.Name)
+		}
+		if r.RetryQueue && r.Action != "publish" {
+			return fmt.Errorf("Route %s: only publish routes can have a retry queue", r.Name)
+		}
+		if r.RetryQueue && (s.Store.Backend == "" || s.Store.Backend == "memory") {
+			return fmt.Errorf("Route %s: the retry queue needs a bolt or nats store, the memory one loses it on restart", r.Name)
+		}
+		if err := r.Breaker.validate(); err != nil {
+			return fmt.Errorf("Route %s breaker %v", r.Name, err)
+		}
+		if r.Idempotent && r.Action != "request" && r.Action != "pipeline" {
+			return fmt.Errorf("Route %s: only request and pipeline routes can be idempotent", r.Name)
+		}
+		if err := r.Compress.validate(); err != nil {
+			return fmt.Errorf("Route %s compress %v", r.Name, err)
+		}
+		if r.JetStream && (r.Action != "publish" || r.RetryQueue) {
+			return fmt.Errorf("Route %s: only publish routes without a retry queue can use jetstream", r.Name)
+		}
+		if r.Compress != nil && !r.JetStream {
+			return fmt.Errorf("Route %s: only jetstream routes can compress", r.Name)
+		}
+		if r.Journal && (r.Action != "request" || s.Journal.Bucket == "") {
+			return fmt.Errorf("Route %s: journals need a request action, and journal.bucket", r.Name)
+		}
+		if r.Probe < 0 {
+			return fmt.Errorf("Route %s has negative probe_bytes", r.Name)
+		}
+		if r.Probe > 0 && (r.Action != "request" || subject.usesBody()) {
+			return fmt.Errorf("Route %s: probes need a request action, and a subject not taken from the body", r.Name)
+		}
+		if r.ProbeService != "" && (r.Probe == 0 || !validToken(r.ProbeService)) {
+			return fmt.Errorf("Route %s: probe_service needs probe_bytes, and a valid service name", r.Name)
+		}
+		if r.Retries < 0 {
+			return fmt.Errorf("Route %s has negative retries", r.Name)
+		}
+		switch r.Auth {
+		case authNone, authMTLS:
+		case authAPIKey:
+			if len(s.APIKeys) == 0 {
+				return fmt.Errorf("Route %s requires an API key, but there are none", r.Name)
+			}
+		default:
+			return fmt.Errorf("Route %s has unknown auth %q", r.Name, r.Auth)
+		}
+	}
+	for _, tap := range s.Taps {
+		if !validPattern(tap) {
+			return fmt.Errorf("Invalid tap %q", tap)
+		}
+	}
+	for name, stages := range s.Pipelines {
+		if err := validatePipeline(name, stages); err != nil {
+			return err
+		}
+	}
+	if err := s.ReadOnly.validate(); err != nil {
+		return err
+	}
+	if err := s.Sessions.validate(s.APIKeys); err != nil {
+		return err
+	}
+	if err := s.SchemaDrift.validate(); err != nil {
+		return err
+	}
+	if _, err := mergeMessages(s.Messages); err != nil {
+		return err
+	}
+	tests := make(map[string]bool)
+	for _, t := range s.SmokeTests {
+		if err := t.validate(); err != nil {
+			return err
+		}
+		if tests[t.Name] {
+			return fmt.Errorf("Duplicate smoke test %s", t.Name)
+		}
+		tests[t.Name] = true
+	}
+	for name, key := range s.APIKeys {
+		if key == "" || key == redactedValue {
+			return fmt.Errorf("API key %s is not set", name)
+		}
+	}
+	return nil
+}
+
+// redacted hides the secrets
+func (s settings) redacted() settings {
+	s.NATS = s.NATS.redacted()
+	if s.APIKeys != nil {
+		keys := make(map[string]string, len(s.APIKeys))
+		for name := range s.APIKeys {
+			keys[name] = redactedValue
+		}
+		s.APIKeys = keys
+	}
+	return s
+}
+
+// diff describes the changes from old to s, one line per change
+func (s settings) diff(old settings) []string {
+	changes := diffFields("nats", old.NATS.redacted(), s.NATS.redacted())
+	if s.NATS.Pass != old.NATS.Pass && s.NATS.redacted() == old.NATS.redacted() {
+		changes = append(changes, "nats pass changed")
+	}
+	changes = append(changes, diffFields("responder", old.Responder, s.Responder)...)
+	changes = append(changes, diffFields("store", old.Store, s.Store)...)
+	changes = append(changes, diffFields("journal", old.Journal, s.Journal)...)
+	oldRoutes := make(map[string]routeConfig)
+	for _, r := range old.Routes {
+		oldRoutes[r.Name] = r
+	}
+	newRoutes := make(map[string]routeConfig)
+	for _, r := range s.Routes {
+		newRoutes[r.Name] = r
+		prev, ok := oldRoutes[r.Name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("route %s added: %s %s", r.Name, r.Action, r.Path))
+			continue
+		}
+		changes = append(changes, diffFields("route "+r.Name, prev, r)...)
+	}
+	for _, r := range old.Routes {
+		if _, ok := newRoutes[r.Name]; !ok {
+			changes = append(changes, fmt.Sprintf("route %s removed", r.Name))
+		}
+	}
+	changes = append(changes, diffList("tap", old.Taps, s.Taps)...)
+	oldTests := make(map[string]smokeTest)
+	for _, t := range old.SmokeTests {
+		oldTests[t.Name] = t
+	}
+	newTests := make(map[string]bool)
+	for _, t := range s.SmokeTests {
+		newTests[t.Name] = true
+		prev, ok := oldTests[t.Name]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("smoke test %s added: %s %s", t.Name, t.Action, t.Subject))
+			continue
+		}
+		changes = append(changes, diffFields("smoke test "+t.Name, prev, t)...)
+	}
+	for _, t := range old.SmokeTests {
+		if !newTests[t.Name] {
+			changes = append(changes, fmt.Sprintf("smoke test %s removed", t.Name))
+		}
+	}
+	changes = append(changes, diffFields("read_only", old.ReadOnly, s.ReadOnly)...)
+	changes = append(changes, diffFields("breaker", old.Breaker, s.Breaker)...)
+	changes = append(changes, diffFields("sessions", old.Sessions, s.Sessions)...)
+	changes = append(changes, diffFields("schema_drift", old.SchemaDrift, s.SchemaDrift)...)
+	changes = append(changes, diffFields("pipelines", old.Pipelines, s.Pipelines)...)
+	changes = append(changes, diffList("api key", keyNames(old.APIKeys), keyNames(s.APIKeys))...)
+	for name, key := range s.APIKeys {
+		if prev, ok := old.APIKeys[name]; ok && prev != key {
+			changes = append(changes, fmt.Sprintf("api key %s changed", name))
+		}
+	}
+	changes = append(changes, diffFields("states", old.States, s.States)...)
+	changes = append(changes, diffFields("messages", old.Messages, s.Messages)...)
+	changes = append(changes, diffFields("limits", old.Limits, s.Limits)...)
+	if s.Canary != old.Canary {
+		changes = append(changes, fmt.Sprintf("canary_percent: %d -> %d", old.Canary, s.Canary))
+	}
+	return changes
+}
+
+// diffFields compares the JSON representation of two values field by field
+func diffFields(prefix string, old, new interface{}) []string {
+	var a, b map[string]interface{}
+	toMap(old, &a)
+	toMap(new, &b)
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var changes []string
+	for _, k := range keys {
+		if !reflect.DeepEqual(a[k], b[k]) {
+			changes = append(changes, fmt.Sprintf("%s %s: %s -> %s", prefix, k, jsonString(a[k]), jsonString(b[k])))
+		}
+	}
+	return changes
+}
+
+// diffList reports the items added to or removed from a list
+func diffList(prefix string, old, new []string) []string {
+	var changes []string
+	seen := make(map[string]bool, len(old))
+	for _, v := range old {
+		seen[v] = true
+	}
+	for _, v := range new {
+		if !seen[v] {
+			changes = append(changes, fmt.Sprintf("%s %s added", prefix, v))
+		}
+		delete(seen, v)
+	}
+	for _, v := range old {
+		if seen[v] {
+			changes = append(changes, fmt.Sprintf("%s %s removed", prefix, v))
+		}
+	}
+	return changes
+}
+
+// keyNames lists the keys of m, sorted
+func keyNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func toMap(v interface{}, m *map[string]interface{}) {
+	data, _ := json.Marshal(v)
+	json.Unmarshal(data, m)
+}
+
+func jsonString(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// SignatureHeader carries the base64 Ed25519 signature of the response body
+const SignatureHeader = "X-Signature"
+
+// loadSigningKey reads an Ed25519 private key from a PKCS#8 PEM file,
+// such as the ones created by `openssl genpkey -algorithm ed25519`
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("Signing key is not an Ed25519 key")
+	}
+	return edKey, nil
+}
+
+// sign adds the signature of the body to the response headers
+func sign(w http.ResponseWriter, key ed25519.PrivateKey, body []byte) {
+	w.Header().Set(SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, body)))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// SmokeRetryInterval is the wait before running the failed blocking
+// smoke tests again
+const SmokeRetryInterval = 30 * time.Second
+
+// smokeResults counts the smoke tests passed and failed
+var smokeResults = expvar.NewMap("smoke_tests")
+
+// smokeTest checks on startup that the gateway can do what its routes
+// need, e.g. that the ACLs allow a subject, or a stream exists
+type smokeTest struct {
+	Name string `json:"name"`
+	// Action is "publish", to a JetStream subject expecting a PubAck,
+	// or "request", expecting a reply
+	Action  string          `json:"action"`
+	Subject string          `json:"subject"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Expect maps JSON paths of the reply to the values they must have
+	Expect map[string]interface{} `json:"expect,omitempty"`
+	// Require lists JSON paths the reply must have
+	Require []string `json:"require,omitempty"`
+	// Timeout of the test, WarmupTimeout by default
+	Timeout duration `json:"timeout,omitempty"`
+	// Block keeps the gateway not ready until the test passes,
+	// otherwise failures are only alerted
+	Block bool `json:"block,omitempty"`
+}
+
+// validate checks the test is complete
+func (t smokeTest) validate() error {
+	if t.Name == "" {
+		return errors.New("Smoke test without name")
+	}
+	if t.Action != "publish" && t.Action != "request" {
+		return fmt.Errorf("Smoke test %s has unknown action %q", t.Name, t.Action)
+	}
+	if !validSubject(t.Subject) {
+		return fmt.Errorf("Smoke test %s has invalid subject %q", t.Name, t.Subject)
+	}
+	if t.Action == "publish" && (len(t.Expect) > 0 || len(t.Require) > 0) {
+		return fmt.Errorf("Smoke test %s expects a reply to a publish", t.Name)
+	}
+	for path := range t.Expect {
+		if _, err := splitPath(path); err != nil {
+			return fmt.Errorf("Smoke test %s: %v", t.Name, err)
+		}
+	}
+	for _, path := range t.Require {
+		if _, err := splitPath(path); err != nil {
+			return fmt.Errorf("Smoke test %s: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// run performs the test
+func (t smokeTest) run(nc *nats.Conn, js jetstream.JetStream) error {
+	timeout := time.Duration(t.Timeout)
+	if timeout <= 0 {
+		timeout = WarmupTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	payload := []byte(t.Payload)
+	if len(payload) == 0 {
+		payload = []byte("{}")
+	}
+	if t.Action == "publish" {
+		_, err := js.Publish(ctx, t.Subject, payload)
+		return err
+	}
+	msg, err := nc.RequestWithContext(ctx, t.Subject, payload)
+	if err != nil {
+		return err
+	}
+	if len(t.Expect) == 0 && len(t.Require) == 0 {
+		return nil
+	}
+	var body interface{}
+	if err := json.Unmarshal(msg.Data, &body); err != nil {
+		return fmt.Errorf("Reply is not JSON: %v", err)
+	}
+	for _, path := range t.Require {
+		if _, err := lookupJSON(body, path); err != nil {
+			return fmt.Errorf("Reply has no %s", path)
+		}
+	}
+	for path, want := range t.Expect {
+		v, err := lookupJSON(body, path)
+		if err != nil {
+			return fmt.Errorf("Reply has no %s", path)
+		}
+		if got, ok := scalarString(v); !ok || got != fmt.Sprint(want) {
+			return fmt.Errorf("Reply has %s = %s, expected %v", path, jsonString(v), want)
+		}
+	}
+	return nil
+}
+
+// runSmokeTests runs the tests, and returns once all the blocking ones
+// have passed. Failed blocking tests are retried every SmokeRetryInterval.
+func runSmokeTests(nc *nats.Conn, js jetstream.JetStream, tests []smokeTest) {
+	for len(tests) > 0 {
+		var failed []smokeTest
+		for _, t := range tests {
+			if err := t.run(nc, js); err != nil {
+				smokeResults.Add("failed", 1)
+				if t.Block {
+					log.Printf("Smoke test %s failed, gateway not ready: %v", t.Name, err)
+					failed = append(failed, t)
+				} else {
+					log.Printf("ALERT smoke test %s failed: %v", t.Name, err)
+				}
+				continue
+			}
+			smokeResults.Add("passed", 1)
+			log.Printf("Smoke test %s passed", t.Name)
+		}
+		if tests = failed; len(tests) > 0 {
+			time.Sleep(SmokeRetryInterval)
+		}
+	}
+}
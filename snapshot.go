@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// SnapshotInterval is the period the route statistics are reported for
+const SnapshotInterval = time.Minute
+
+// MaxLatencySamples is the number of latencies kept per route and
+// interval to estimate percentiles
+const MaxLatencySamples = 1024
+
+// routeWindow accumulates the requests of a route in an interval
+type routeWindow struct {
+	requests     int
+	clientErrors int
+	serverErrors int
+	latencies    []time.Duration
+}
+
+// add records a request, keeping a uniform sample of the latencies
+func (w *routeWindow) add(status int, latency time.Duration) {
+	w.requests++
+	switch {
+	case status >= 500:
+		w.serverErrors++
+	case status >= 400:
+		w.clientErrors++
+	}
+	if len(w.latencies) < MaxLatencySamples {
+		w.latencies = append(w.latencies, latency)
+	} else if i := rand.Intn(w.requests); i < MaxLatencySamples {
+		w.latencies[i] = latency
+	}
+}
+
+// routeStats keeps the statistics of the current and the last complete
+// interval, by route name
+type routeStats struct {
+	mu       sync.Mutex
+	start    time.Time
+	current  map[string]*routeWindow
+	previous map[string]*routeWindow
+}
+
+var stats = &routeStats{current: make(map[string]*routeWindow)}
+
+// rotate starts a new interval if the current one is over
+func (s *routeStats) rotate(now time.Time) {
+	start := now.Truncate(SnapshotInterval)
+	if start.Equal(s.start) {
+		return
+	}
+	if start.Sub(s.start) == SnapshotInterval {
+		s.previous = s.current
+	} else {
+		s.previous = nil
+	}
+	s.start, s.current = start, make(map[string]*routeWindow)
+}
+
+// record counts a request to the route
+func (s *routeStats) record(route string, status int, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(time.Now())
+	w, ok := s.current[route]
+	if !ok {
+		w = &routeWindow{}
+		s.current[route] = w
+	}
+	w.add(status, latency)
+}
+
+// routeSnapshot summarizes the requests to a route in an interval
+type routeSnapshot struct {
+	Requests     int     `json:"requests"`
+	ClientErrors int     `json:"client_errors"`
+	ServerErrors int     `json:"server_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	Latency      struct {
+		P50 duration `json:"p50"`
+		P90 duration `json:"p90"`
+		P99 duration `json:"p99"`
+		Max duration `json:"max"`
+	} `json:"latency"`
+}
+
+// last summarizes the last complete interval, and tells when it started
+func (s *routeStats) last() (time.Time, map[string]routeSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(time.Now())
+	routes := make(map[string]routeSnapshot, len(s.previous))
+	for name, w := range s.previous {
+		rs := routeSnapshot{Requests: w.requests, ClientErrors: w.clientErrors, ServerErrors: w.serverErrors}
+		rs.ErrorRate = float64(w.clientErrors+w.serverErrors) / float64(w.requests)
+		latencies := append([]time.Duration(nil), w.latencies...)
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		rs.Latency.P50 = duration(percentile(latencies, 0.5))
+		rs.Latency.P90 = duration(percentile(latencies, 0.9))
+		rs.Latency.P99 = duration(percentile(latencies, 0.99))
+		rs.Latency.Max = duration(percentile(latencies, 1))
+		routes[name] = rs
+	}
+	return s.start.Add(-SnapshotInterval), routes
+}
+
+// percentile of sorted latencies, 0 if there are none
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// measure records the status and latency of the requests to the route
+func measure(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		stats.record(route, status, time.Since(start))
+	})
+}
+
+// streamSummary describes a JetStream stream in the snapshot
+type streamSummary struct {
+	Name      string   `json:"name"`
+	Subjects  []string `json:"subjects"`
+	Messages  uint64   `json:"messages"`
+	Bytes     uint64   `json:"bytes"`
+	Consumers int      `json:"consumers"`
+}
+
+// snapshot combines the state of the gateway in a single document
+type snapshot struct {
+	Time       time.Time `json:"time"`
+	Connection struct {
+		connStatus
+		URL       string          `json:"url"`
+		Stats     nats.Statistics `json:"stats"`
+		JetStream jsInfo          `json:"jetstream"`
+	} `json:"connection"`
+	// Routes are the statistics of the last complete interval
+	Interval duration                 `json:"interval"`
+	Since    time.Time                `json:"since"`
+	Routes   map[string]routeSnapshot `json:"routes"`
+	Streams  []streamSummary          `json:"streams"`
+	// StreamsError tells why the streams could not be listed
+	StreamsError string `json:"streams_error,omitempty"`
+	// Sessions counts the open streaming sessions, and the subjects
+	// they are subscribed to
+	Sessions  keyUsage      `json:"sessions"`
+	Resources resourceUsage `json:"resources"`
+}
+
+// snapshot reports the connection, routes, streams and resources at once,
+// for dashboards that can't scrape metrics
+func (gw *gateway) snapshot(w http.ResponseWriter, r *http.Request) {
+	var s snapshot
+	s.Time = time.Now()
+	s.Connection.connStatus = connection.status()
+	s.Connection.URL = gw.nc.ConnectedUrlRedacted()
+	s.Connection.Stats = gw.nc.Stats()
+	s.Connection.JetStream = gw.jetStreamInfo(r.Context())
+	s.Interval = duration(SnapshotInterval)
+	s.Since, s.Routes = stats.last()
+	s.Streams = []streamSummary{}
+	ctx, cancel := context.WithTimeout(r.Context(), AdminTimeout)
+	defer cancel()
+	streams := gw.js.ListStreams(ctx)
+	for info := range streams.Info() {
+		s.Streams = append(s.Streams, streamSummary{
+			Name:      info.Config.Name,
+			Subjects:  info.Config.Subjects,
+			Messages:  info.State.Msgs,
+			Bytes:     info.State.Bytes,
+			Consumers: info.State.Consumers,
+		})
+	}
+	if err := streams.Err(); err != nil {
+		s.StreamsError = err.Error()
+	}
+	s.Sessions = sessions.total()
+	s.Resources = sampleResources()
+	writeJSON(w, http.StatusOK, s)
+}
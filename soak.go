@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// Subjects exercised by the soak test
+const (
+	soakTopic   = "soak.topic"
+	soakRequest = "soak.request"
+)
+
+// soakServerCommand runs the NATS server of the soak test, in its own
+// process so its resources are not counted as the gateway's
+const soakServerCommand = "soak-nats-server"
+
+// soakAdminCalls are the admin API endpoints exercised by the soak test.
+// Those changing the gateway state are left out.
+var soakAdminCalls = []string{
+	"/admin/config",
+	"/admin/config/changes",
+	"/admin/connection",
+	"/admin/snapshot",
+	"/admin/sessions",
+	"/admin/schemas",
+	"/admin/retries",
+	"/admin/retention?subject=" + soakTopic,
+	"/debug/vars",
+}
+
+// soakConfig configures the soak test mode
+type soakConfig struct {
+	Duration    time.Duration
+	Interval    time.Duration
+	Concurrency int
+	// Tolerance is the relative growth allowed to each resource
+	Tolerance float64
+}
+
+// soakFlags registers the flags of the soak test mode
+func soakFlags() *soakConfig {
+	sc := &soakConfig{}
+	flag.DurationVar(&sc.Duration, "duration", 10*time.Minute, "How long to run the soak test for")
+	flag.DurationVar(&sc.Interval, "interval", 30*time.Second, "Period between resource samples")
+	flag.IntVar(&sc.Concurrency, "concurrency", 8, "Number of concurrent HTTP clients")
+	flag.Float64Var(&sc.Tolerance, "tolerance", 0.2, "Relative growth allowed to each resource")
+	return sc
+}
+
+// runSoakServer runs a NATS server with JetStream, writes its URL to
+// stdout, and stops when stdin is closed, so it does not outlive the
+// soak test
+func runSoakServer() error {
+	storeDir, err := ioutil.TempDir("", "nats-gw-soak")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(storeDir)
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoSigs:    true,
+	})
+	if err != nil {
+		return err
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		return errors.New("NATS server not ready")
+	}
+	fmt.Println(ns.ClientURL())
+	io.Copy(ioutil.Discard, os.Stdin)
+	return nil
+}
+
+// startSoakServer runs the NATS server of the soak test in a child
+// process, and returns its URL
+func startSoakServer() (url string, stop func(), err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	cmd := exec.Command(exe, soakServerCommand)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return "", nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return "", nil, err
+	}
+	stop = func() {
+		stdin.Close()
+		cmd.Wait()
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		stop()
+		return "", nil, fmt.Errorf("NATS server did not start: %v", err)
+	}
+	return strings.TrimSpace(line), stop, nil
+}
+
+// runSoak exercises all the endpoints of a gateway, its admin API and
+// streaming sessions, while sampling its own resources. The NATS server
+// runs in a child process. It fails if any resource keeps growing past
+// the tolerance.
+func runSoak(cfg config, sc soakConfig) error {
+	if sc.Concurrency <= 0 || sc.Interval <= 0 || sc.Duration < 2*sc.Interval {
+		return errors.New("Concurrency and interval must be positive, and duration at least two intervals")
+	}
+	url, stopServer, err := startSoakServer()
+	if err != nil {
+		return err
+	}
+	defer stopServer()
+	nc, err := nats.Connect(url, cfg.options(natsConfig{})...)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	connection.set(stateConnected)
+	echo, err := nc.Subscribe(soakRequest, func(msg *nats.Msg) {
+		msg.Respond(msg.Data)
+	})
+	if err != nil {
+		return err
+	}
+	defer echo.Unsubscribe()
+
+	s := defaultSettings(cfg)
+	s.NATS.URL = url
+	s.Routes = append(s.Routes, routeConfig{
+		Name: "replies", Path: "/replies/{topic}", Subject: DefaultSubject, Action: "publish_reply",
+		Timeout: duration(cfg.RequestsTimeout), Deadline: duration(DefaultDeadline), Auth: authNone,
+	})
+	s.Sessions.Subjects = []string{"soak.>"}
+	accessLog = ioutil.Discard
+	gw, err := newGateway(nc, cfg, s)
+	if err != nil {
+		return err
+	}
+	if err := warmUp(nc, []string{soakRequest}); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: gw}
+	go srv.Serve(ln)
+	defer srv.Close()
+	adminLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	admin := &http.Server{Handler: gw.adminRoutes()}
+	go admin.Serve(adminLn)
+	defer admin.Close()
+
+	base := "http://" + ln.Addr().String()
+	adminBase := "http://" + adminLn.Addr().String()
+	stop := make(chan struct{})
+	var sent, failed int64
+	var workers sync.WaitGroup
+	for i := 0; i < sc.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			client := &http.Client{Timeout: 10 * time.Second}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, call := range []struct{ method, url string }{
+					{"POST", base + "/topics/" + soakTopic},
+					{"POST", base + "/requests/" + soakRequest},
+					{"GET", base + "/ready"},
+				} {
+					atomic.AddInt64(&sent, 1)
+					if err := soakCall(client, call.method, call.url, nil); err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+				}
+				for _, path := range soakAdminCalls {
+					atomic.AddInt64(&sent, 1)
+					if err := soakCall(client, "GET", adminBase+path, nil); err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+				}
+				atomic.AddInt64(&sent, 1)
+				if err := soakSession(client, base); err != nil {
+					log.Print("Soak session failed: ", err)
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	log.Printf("Soak testing for %s with %d clients", sc.Duration, sc.Concurrency)
+	var samples []resourceUsage
+	ticker := time.NewTicker(sc.Interval)
+	end := time.After(sc.Duration)
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			runtime.GC()
+			u := sampleResources()
+			samples = append(samples, u)
+			log.Printf("Sample %d: %d goroutines, %d fds, %d heap bytes, %d calls, %d failed",
+				len(samples), u.Goroutines, u.FDs, u.HeapBytes, atomic.LoadInt64(&sent), atomic.LoadInt64(&failed))
+		case <-end:
+			break loop
+		}
+	}
+	ticker.Stop()
+	close(stop)
+	workers.Wait()
+	return soakReport(samples, sc.Tolerance, atomic.LoadInt64(&sent), atomic.LoadInt64(&failed))
+}
+
+// soakCall sends a request and expects a 2xx answer
+func soakCall(client *http.Client, method, url string, header http.Header) error {
+	var body io.Reader
+	if method == "POST" {
+		body = bytes.NewBufferString(`{"soak": true}`)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return nil
+}
+
+// soakSession opens a streaming session subscribed to the soak topic,
+// sends a request with its reply to the session, and waits for the reply
+// event before closing it
+func soakSession(client *http.Client, base string) error {
+	resp, err := client.Get(base + "/sessions?subscribe=" + soakTopic)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /sessions: %s", resp.Status)
+	}
+	events := bufio.NewReader(resp.Body)
+	next := func() (event, data string, err error) {
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				return "", "", err
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "" && event != "":
+				return event, data, nil
+			case strings.HasPrefix(line, "event: "):
+				event = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				data = line[len("data: "):]
+			}
+		}
+	}
+	event, id, err := next()
+	if err != nil {
+		return err
+	}
+	if event != "session" {
+		return fmt.Errorf("Expected a session event, got %s", event)
+	}
+	header := http.Header{SessionHeader: []string{id}}
+	if err := soakCall(client, "POST", base+"/replies/"+soakRequest, header); err != nil {
+		return err
+	}
+	for {
+		if event, _, err = next(); err != nil {
+			return err
+		}
+		if event == "reply" {
+			return nil
+		}
+	}
+}
+
+// soakReport checks the samples for leaks. The first sample is the
+// baseline; a resource leaks if its last sample exceeds the baseline by
+// more than the tolerance (plus some slack for small values), and it
+// was still growing in the second half of the test.
+func soakReport(samples []resourceUsage, tolerance float64, sent, failed int64) error {
+	if len(samples) < 2 {
+		return errors.New("Not enough samples to detect leaks")
+	}
+	checks := []struct {
+		name  string
+		slack float64
+		value func(u resourceUsage) float64
+	}{
+		{"goroutines", 10, func(u resourceUsage) float64 { return float64(u.Goroutines) }},
+		{"fds", 10, func(u resourceUsage) float64 { return float64(u.FDs) }},
+		{"heap bytes", 8 << 20, func(u resourceUsage) float64 { return float64(u.HeapBytes) }},
+	}
+	log.Printf("Soak test finished: %d calls, %d failed", sent, failed)
+	var leaks []string
+	half := len(samples) / 2
+	for _, c := range checks {
+		first, last := c.value(samples[0]), c.value(samples[len(samples)-1])
+		var maxFirst, maxSecond float64
+		for i, u := range samples {
+			if v := c.value(u); i < half && v > maxFirst {
+				maxFirst = v
+			} else if i >= half && v > maxSecond {
+				maxSecond = v
+			}
+		}
+		grew := last > first*(1+tolerance)+c.slack && maxSecond > maxFirst
+		verdict := "ok"
+		if grew {
+			verdict = "LEAK"
+			leaks = append(leaks, c.name)
+		}
+		log.Printf("%-10s baseline %.0f, final %.0f: %s", c.name, first, last, verdict)
+	}
+	if len(leaks) > 0 {
+		return fmt.Errorf("Resources growing unbounded: %v", leaks)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d calls failed", failed, sent)
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	bolt "go.etcd.io/bbolt"
+)
+
+// StoreTimeout is the time allowed to each operation on a NATS KV store
+const StoreTimeout = 5 * time.Second
+
+// errNotFound is returned by a store when the key does not exist
+var errNotFound = errors.New("Key not found")
+
+// store keeps the gateway state. Keys are made of letters, digits and
+// dots, so they are valid in all the backends.
+type store interface {
+	Get(key string) ([]byte, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+	// Keys lists the keys with the given prefix, ending in a dot, sorted
+	Keys(prefix string) ([]string, error)
+	// Incr adds delta to the counter at key, zero if missing, and returns
+	// the result. It is atomic, also for gateways sharing the store.
+	Incr(key string, delta int64) (int64, error)
+	// Swap sets the value at key if its current value is old, or if it
+	// is missing when old is nil, and fails with errChanged otherwise.
+	// It is atomic, also for gateways sharing the store.
+	Swap(key string, old, value []byte) error
+	Close() error
+}
+
+// StoreRetries is the number of attempts of an Incr that conflicts with
+// another gateway
+const StoreRetries = 10
+
+// errConflict is returned when an Incr keeps conflicting
+var errConflict = errors.New("Too many conflicting updates")
+
+// errChanged is returned by Swap when the value is not the expected one
+var errChanged = errors.New("Key changed")
+
+// counterValue decodes a counter, missing ones are zero
+func counterValue(data []byte) (int64, error) {
+	if data == nil {
+		return 0, nil
+	}
+	return strconv.ParseInt(string(data), 10, 64)
+}
+
+// storeConfig selects the storage backend
+type storeConfig struct {
+	// Backend is "memory" (default), "bolt" or "nats"
+	Backend string `json:"backend,omitempty"`
+	// Path of the BoltDB file
+	Path string `json:"path,omitempty"`
+	// Bucket of the NATS KV store, or of the BoltDB file
+	Bucket string `json:"bucket,omitempty"`
+}
+
+// DefaultBucket is the bucket used when none is configured
+const DefaultBucket = "nats_gw"
+
+// validate checks the backend is known and has what it needs
+func (c storeConfig) validate() error {
+	switch c.Backend {
+	case "", "memory", "nats":
+	case "bolt":
+		if c.Path == "" {
+			return errors.New("Bolt store needs a path")
+		}
+	default:
+		return fmt.Errorf("Unknown store backend %q", c.Backend)
+	}
+	return nil
+}
+
+// openStore opens the configured backend
+func openStore(c storeConfig, js jetstream.JetStream) (store, error) {
+	bucket := c.Bucket
+	if bucket == "" {
+		bucket = DefaultBucket
+	}
+	switch c.Backend {
+	case "bolt":
+		return openBoltStore(c.Path, bucket)
+	case "nats":
+		return openKVStore(js, bucket)
+	default:
+		return newMemoryStore(), nil
+	}
+}
+
+// memoryStore keeps the state in memory, it is lost on restart
+type memoryStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string][]byte)}
+}
+
+func (m *memoryStore) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.data[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return v, nil
+}
+
+func (m *memoryStore) Put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+func (m *memoryStore) Keys(prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for k := range m.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *memoryStore) Incr(key string, delta int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, err := counterValue(m.data[key])
+	if err != nil {
+		return 0, err
+	}
+	n += delta
+	m.data[key] = []byte(strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+func (m *memoryStore) Swap(key string, old, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	current, ok := m.data[key]
+	if ok != (old != nil) || !bytes.Equal(current, old) {
+		return errChanged
+	}
+	m.data[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// boltStore keeps the state in a local BoltDB file. The file is locked
+// while open, so on upgrades the new process opens it in the background,
+// once the previous one has stopped serving and closed it, and its
+// operations wait until then.
+type boltStore struct {
+	db     *bolt.DB
+	path   string
+	bucket []byte
+	// opened is closed once the file is open
+	opened chan struct{}
+}
+
+func openBoltStore(path, bucket string) (*boltStore, error) {
+	b := &boltStore{path: path, bucket: []byte(bucket), opened: make(chan struct{})}
+	if os.Getenv(UpgradeEnv) == "" {
+		if err := b.open(time.Second); err != nil {
+			return nil, err
+		}
+		close(b.opened)
+		return b, nil
+	}
+	// The previous process only closes the file after this one is
+	// ready, so it can't be waited for here
+	go func() {
+		if err := b.open(UpgradeTimeout + ShutdownTimeout); err != nil {
+			log.Fatal("Error opening the store released by the previous process: ", err)
+		}
+		log.Print("Opened the store released by the previous process")
+		close(b.opened)
+	}()
+	return b, nil
+}
+
+// open opens the file, waiting up to timeout for another process to
+// release it
+func (b *boltStore) open(timeout time.Duration) error {
+	db, err := bolt.Open(b.path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return fmt.Errorf("Error opening %s: %v", b.path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(b.bucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	b.db = db
+	return nil
+}
+
+// file returns the database, once it is open
+func (b *boltStore) file() *bolt.DB {
+	<-b.opened
+	return b.db
+}
+
+func (b *boltStore) Get(key string) ([]byte, error) {
+	var value []byte
+	err := b.file().View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(b.bucket).Get([]byte(key))
+		if v == nil {
+			return errNotFound
+		}
+		value = append([]byte(nil), v...)
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltStore) Put(key string, value []byte) error {
+	return b.file().Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Put([]byte(key), value)
+	})
+}
+
+func (b *boltStore) Delete(key string) error {
+	return b.file().Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltStore) Incr(key string, delta int64) (int64, error) {
+	var n int64
+	err := b.file().Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		var err error
+		if n, err = counterValue(bucket.Get([]byte(key))); err != nil {
+			return err
+		}
+		n += delta
+		return bucket.Put([]byte(key), []byte(strconv.FormatInt(n, 10)))
+	})
+	return n, err
+}
+
+func (b *boltStore) Swap(key string, old, value []byte) error {
+	return b.file().Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		current := bucket.Get([]byte(key))
+		if (current != nil) != (old != nil) || !bytes.Equal(current, old) {
+			return errChanged
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (b *boltStore) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := b.file().View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(b.bucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+func (b *boltStore) Close() error {
+	return b.file().Close()
+}
+
+// kvStore keeps the state in a NATS KV bucket, shared by all the
+// gateways connected to the same JetStream domain.
+type kvStore struct {
+	kv jetstream.KeyValue
+}
+
+func openKVStore(js jetstream.JetStream, bucket string) (*kvStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	kv, err := js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: bucket})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening KV bucket %s: %v", bucket, err)
+	}
+	return &kvStore{kv: kv}, nil
+}
+
+func (s *kvStore) Get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	entry, err := s.kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, errNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entry.Value(), nil
+}
+
+func (s *kvStore) Put(key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	_, err := s.kv.Put(ctx, key, value)
+	return err
+}
+
+func (s *kvStore) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	return s.kv.Purge(ctx, key)
+}
+
+func (s *kvStore) Keys(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	// The prefixes end with a dot, so the server can filter the keys
+	lister, err := s.kv.ListKeysFiltered(ctx, prefix+">")
+	if err != nil {
+		return nil, err
+	}
+	defer lister.Stop()
+	// The lister may report a key more than once if it is being written
+	seen := make(map[string]bool)
+	var keys []string
+	for k := range lister.Keys() {
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	// The lister stops early, without an error, when the context expires
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Incr updates the counter with the revision it read, and tries again
+// if another gateway updated it first
+func (s *kvStore) Incr(key string, delta int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	for attempt := 0; attempt < StoreRetries; attempt++ {
+		entry, err := s.kv.Get(ctx, key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			_, err = s.kv.Create(ctx, key, []byte(strconv.FormatInt(delta, 10)))
+			if errors.Is(err, jetstream.ErrKeyExists) {
+				continue
+			}
+			return delta, err
+		}
+		if err != nil {
+			return 0, err
+		}
+		n, err := counterValue(entry.Value())
+		if err != nil {
+			return 0, err
+		}
+		n += delta
+		_, err = s.kv.Update(ctx, key, []byte(strconv.FormatInt(n, 10)), entry.Revision())
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			continue
+		}
+		return n, err
+	}
+	return 0, errConflict
+}
+
+// Swap creates the key, or updates it with the revision it read
+func (s *kvStore) Swap(key string, old, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), StoreTimeout)
+	defer cancel()
+	if old == nil {
+		_, err := s.kv.Create(ctx, key, value)
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return errChanged
+		}
+		return err
+	}
+	entry, err := s.kv.Get(ctx, key)
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return errChanged
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(entry.Value(), old) {
+		return errChanged
+	}
+	_, err = s.kv.Update(ctx, key, value, entry.Revision())
+	if errors.Is(err, jetstream.ErrKeyExists) {
+		return errChanged
+	}
+	return err
+}
+
+func (s *kvStore) Close() error {
+	return nil
+}
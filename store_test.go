@@ -0,0 +1,34 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSwap(t *testing.T) {
+	bolt, err := openBoltStore(filepath.Join(t.TempDir(), "state.db"), DefaultBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+	for name, st := range map[string]store{"memory": newMemoryStore(), "bolt": bolt} {
+		if err := st.Swap("k", []byte("a"), []byte("b")); err != errChanged {
+			t.Errorf("%s: swap of a missing key = %v, want errChanged", name, err)
+		}
+		if err := st.Swap("k", nil, []byte("a")); err != nil {
+			t.Errorf("%s: create = %v", name, err)
+		}
+		if err := st.Swap("k", nil, []byte("b")); err != errChanged {
+			t.Errorf("%s: create of an existing key = %v, want errChanged", name, err)
+		}
+		if err := st.Swap("k", []byte("b"), []byte("c")); err != errChanged {
+			t.Errorf("%s: swap of another value = %v, want errChanged", name, err)
+		}
+		if err := st.Swap("k", []byte("a"), []byte("b")); err != nil {
+			t.Errorf("%s: swap = %v", name, err)
+		}
+		if v, err := st.Get("k"); err != nil || string(v) != "b" {
+			t.Errorf("%s: value = %q, %v, want b", name, v, err)
+		}
+	}
+}
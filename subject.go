@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultSubject publishes to the topic in the URL
+const DefaultSubject = "{topic}"
+
+// subjectTemplate builds the NATS subject of a message. Templates mix
+// literal text with {topic}, the topic in the URL, and {$.path}, a field
+// of the JSON body, e.g. "events.{$.type}".
+type subjectTemplate []subjectPart
+
+type subjectPart struct {
+	literal string
+	topic   bool
+	path    string
+}
+
+// parseSubject compiles a subject template
+func parseSubject(t string) (subjectTemplate, error) {
+	if t == "" {
+		t = DefaultSubject
+	}
+	var parts subjectTemplate
+	for t != "" {
+		start := strings.IndexByte(t, '{')
+		if start < 0 {
+			parts = append(parts, subjectPart{literal: t})
+			break
+		}
+		end := strings.IndexByte(t[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("Unclosed { in subject template %q", t)
+		}
+		if start > 0 {
+			parts = append(parts, subjectPart{literal: t[:start]})
+		}
+		v := t[start+1 : start+end]
+		switch {
+		case v == "topic":
+			parts = append(parts, subjectPart{topic: true})
+		case strings.HasPrefix(v, "$"):
+			if _, err := splitPath(v); err != nil {
+				return nil, err
+			}
+			parts = append(parts, subjectPart{path: v})
+		default:
+			return nil, fmt.Errorf("Unknown variable {%s} in subject template", v)
+		}
+		t = t[start+end+1:]
+	}
+	return parts, nil
+}
+
+// usesTopic is true if the template includes the topic in the URL
+func (t subjectTemplate) usesTopic() bool {
+	for _, p := range t {
+		if p.topic {
+			return true
+		}
+	}
+	return false
+}
+
+// usesBody is true if the template takes values from the JSON body
+func (t subjectTemplate) usesBody() bool {
+	for _, p := range t {
+		if p.path != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// render builds the subject for a message. Values taken from the body
+// must be a single subject token.
+func (t subjectTemplate) render(topic string, data []byte) (string, error) {
+	var body interface{}
+	var sb strings.Builder
+	for _, p := range t {
+		switch {
+		case p.topic:
+			sb.WriteString(topic)
+		case p.path != "":
+			if body == nil {
+				if err := json.Unmarshal(data, &body); err != nil {
+					return "", fmt.Errorf("Body is not valid JSON: %v", err)
+				}
+			}
+			v, err := lookupJSON(body, p.path)
+			if err != nil {
+				return "", err
+			}
+			token, ok := scalarString(v)
+			if !ok || !validToken(token) {
+				return "", fmt.Errorf("Field %s is not a valid subject token", p.path)
+			}
+			sb.WriteString(token)
+		default:
+			sb.WriteString(p.literal)
+		}
+	}
+	subject := sb.String()
+	if !validSubject(subject) {
+		return "", fmt.Errorf("Invalid subject %q", subject)
+	}
+	return subject, nil
+}
+
+// resolve renders the subject for a request, and the HTTP status to
+// answer if it cannot be built.
+func (t subjectTemplate) resolve(topic string, data []byte) (string, int, error) {
+	if topic == "" && t.usesTopic() {
+		return "", http.StatusNotFound, errors.New("Missing topic")
+	}
+	subject, err := t.render(topic, data)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	return subject, http.StatusOK, nil
+}
+
+// validToken checks s can be used as a single token of a subject
+func validToken(s string) bool {
+	return s != "" && !strings.ContainsAny(s, ".*> \t\r\n")
+}
+
+// validSubject checks s is a valid subject to publish to
+func validSubject(s string) bool {
+	for _, token := range strings.Split(s, ".") {
+		if !validToken(token) {
+			return false
+		}
+	}
+	return true
+}
+
+// validPattern checks a subject that may include * and > wildcards
+func validPattern(s string) bool {
+	tokens := strings.Split(s, ".")
+	for i, token := range tokens {
+		if token == "*" || (token == ">" && i == len(tokens)-1) {
+			continue
+		}
+		if !validToken(token) {
+			return false
+		}
+	}
+	return true
+}
+
+// patternCovers is true if every subject matching the pattern also
+// matches the allowed one
+func patternCovers(allowed, pattern string) bool {
+	a := strings.Split(allowed, ".")
+	p := strings.Split(pattern, ".")
+	for i, token := range a {
+		if token == ">" {
+			return len(p) > i
+		}
+		if i >= len(p) || p[i] == ">" || (token != "*" && token != p[i]) {
+			return false
+		}
+	}
+	return len(a) == len(p)
+}
+
+// coveredByAny is true if any of the allowed patterns covers the pattern
+func coveredByAny(allowed []string, pattern string) bool {
+	for _, a := range allowed {
+		if patternCovers(a, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPath splits a JSON path like $.a.b[2].c into keys and indexes
+func splitPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSON path %q must start with $", path)
+	}
+	var keys []string
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("Empty key in JSON path %q", path)
+			}
+			keys = append(keys, rest[1:end+1])
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("Unclosed [ in JSON path %q", path)
+			}
+			if _, err := strconv.Atoi(rest[1:end]); err != nil {
+				return nil, fmt.Errorf("Invalid index in JSON path %q", path)
+			}
+			keys = append(keys, rest[:end+1])
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("Invalid JSON path %q", path)
+		}
+	}
+	return keys, nil
+}
+
+// errNoField is returned when the JSON path is not found in the document
+var errNoField = errors.New("field not found")
+
+// lookupJSON finds the value at path in a decoded JSON document
+func lookupJSON(doc interface{}, path string) (interface{}, error) {
+	keys, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	v := doc
+	for _, key := range keys {
+		if strings.HasPrefix(key, "[") {
+			arr, ok := v.([]interface{})
+			i, _ := strconv.Atoi(key[1 : len(key)-1])
+			if !ok || i < 0 || i >= len(arr) {
+				return nil, fmt.Errorf("%s: %w", path, errNoField)
+			}
+			v = arr[i]
+			continue
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", path, errNoField)
+		}
+		if v, ok = obj[key]; !ok {
+			return nil, fmt.Errorf("%s: %w", path, errNoField)
+		}
+	}
+	return v, nil
+}
+
+// scalarString formats strings, numbers and booleans
+func scalarString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseSubject(t *testing.T) {
+	tests := []struct {
+		template string
+		topic    bool
+		body     bool
+		wantErr  bool
+	}{
+		{"", true, false, false},
+		{"{topic}", true, false, false},
+		{"events.created", false, false, false},
+		{"events.{$.type}", false, true, false},
+		{"{topic}.{$.a.b[0]}", true, true, false},
+		{"events.{type}", false, false, true},
+		{"events.{$.type", false, false, true},
+		{"events.{$type}", false, false, true},
+		{"events.{$.a[x]}", false, false, true},
+	}
+	for _, tt := range tests {
+		parsed, err := parseSubject(tt.template)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSubject(%q) error = %v, want error %v", tt.template, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if parsed.usesTopic() != tt.topic || parsed.usesBody() != tt.body {
+			t.Errorf("parseSubject(%q) uses topic %v and body %v, want %v and %v",
+				tt.template, parsed.usesTopic(), parsed.usesBody(), tt.topic, tt.body)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	tests := []struct {
+		template string
+		topic    string
+		data     string
+		want     string
+		status   int
+	}{
+		{"{topic}", "orders", "", "orders", http.StatusOK},
+		{"{topic}", "", "", "", http.StatusNotFound},
+		{"events.{$.type}", "", `{"type": "created"}`, "events.created", http.StatusOK},
+		{"events.{$.n}", "", `{"n": 42}`, "events.42", http.StatusOK},
+		{"events.{$.ok}", "", `{"ok": true}`, "events.true", http.StatusOK},
+		{"events.{$.items[1].id}", "", `{"items": [{"id": "a"}, {"id": "b"}]}`, "events.b", http.StatusOK},
+		{"{topic}.{$.type}", "eu", `{"type": "created"}`, "eu.created", http.StatusOK},
+		{"events.{$.type}", "", `{}`, "", http.StatusBadRequest},
+		{"events.{$.type}", "", `not json`, "", http.StatusBadRequest},
+		{"events.{$.type}", "", `{"type": "a.b"}`, "", http.StatusBadRequest},
+		{"events.{$.type}", "", `{"type": "*"}`, "", http.StatusBadRequest},
+		{"events.{$.type}", "", `{"type": {"x": 1}}`, "", http.StatusBadRequest},
+		{"events.{$.type}", "", `{"type": ""}`, "", http.StatusBadRequest},
+		{"{topic}", "a..b", "", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		parsed, err := parseSubject(tt.template)
+		if err != nil {
+			t.Fatalf("parseSubject(%q): %v", tt.template, err)
+		}
+		got, status, err := parsed.resolve(tt.topic, []byte(tt.data))
+		if status != tt.status || got != tt.want || (err != nil) != (tt.status != http.StatusOK) {
+			t.Errorf("resolve(%q, %q, %s) = %q, %d, %v, want %q, %d",
+				tt.template, tt.topic, tt.data, got, status, err, tt.want, tt.status)
+		}
+	}
+}
+
+func TestValidPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    bool
+	}{
+		{"orders", true},
+		{"orders.*", true},
+		{"orders.>", true},
+		{"orders.*.eu", true},
+		{"orders.>.eu", false},
+		{"orders..eu", false},
+		{"orders.e u", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validPattern(tt.pattern); got != tt.want {
+			t.Errorf("validPattern(%q) = %v, want %v", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+func TestPatternCovers(t *testing.T) {
+	tests := []struct {
+		allowed, pattern string
+		want             bool
+	}{
+		{"orders.>", "orders.eu", true},
+		{"orders.>", "orders.eu.>", true},
+		{"orders.>", "orders", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders.*", true},
+		{"orders.*", "orders.>", false},
+		{"orders.*", "orders.eu.new", false},
+		{"orders.eu", "orders.*", false},
+		{"prices.*", "orders.eu", false},
+	}
+	for _, tt := range tests {
+		if got := patternCovers(tt.allowed, tt.pattern); got != tt.want {
+			t.Errorf("patternCovers(%q, %q) = %v, want %v", tt.allowed, tt.pattern, got, tt.want)
+		}
+	}
+}
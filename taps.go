@@ -0,0 +1,83 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats.go"
+)
+
+// tap counts the messages and bytes seen on a subject pattern,
+// without forwarding them anywhere.
+type tap struct {
+	sub      *nats.Subscription
+	messages int64
+	bytes    int64
+}
+
+// tapCounts is the snapshot of a tap published in the metrics
+type tapCounts struct {
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// tapSet holds the taps currently subscribed, by subject
+type tapSet struct {
+	mu   sync.Mutex
+	taps map[string]*tap
+}
+
+var activeTaps = &tapSet{taps: make(map[string]*tap)}
+
+func init() {
+	expvar.Publish("taps", expvar.Func(activeTaps.counts))
+}
+
+// counts returns the counters of every tap
+func (ts *tapSet) counts() interface{} {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	counts := make(map[string]tapCounts, len(ts.taps))
+	for subject, t := range ts.taps {
+		counts[subject] = tapCounts{
+			Messages: atomic.LoadInt64(&t.messages),
+			Bytes:    atomic.LoadInt64(&t.bytes),
+		}
+	}
+	return counts
+}
+
+// update subscribes to the new subjects and unsubscribes from the ones
+// no longer listed. Taps that remain keep their counters.
+func (ts *tapSet) update(nc *nats.Conn, subjects []string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	wanted := make(map[string]bool, len(subjects))
+	for _, subject := range subjects {
+		wanted[subject] = true
+		if _, ok := ts.taps[subject]; ok {
+			continue
+		}
+		t := &tap{}
+		sub, err := nc.Subscribe(subject, func(msg *nats.Msg) {
+			atomic.AddInt64(&t.messages, 1)
+			atomic.AddInt64(&t.bytes, int64(len(msg.Data)))
+		})
+		if err != nil {
+			log.Printf("Error subscribing tap on %s: %+v", subject, err)
+			continue
+		}
+		t.sub = sub
+		ts.taps[subject] = t
+	}
+	for subject, t := range ts.taps {
+		if !wanted[subject] {
+			if err := t.sub.Unsubscribe(); err != nil {
+				log.Printf("Error unsubscribing tap on %s: %+v", subject, err)
+			}
+			delete(ts.taps, subject)
+		}
+	}
+}
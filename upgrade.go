@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// UpgradeEnv lists the names of the listeners inherited from the
+// previous process, in the order of their file descriptors
+const UpgradeEnv = "NATS_GW_UPGRADE"
+
+// UpgradeTimeout is how long the new process has to become ready
+const UpgradeTimeout = 2 * time.Minute
+
+// Inherited files: the pipe to tell the parent the new process is
+// ready, and then the listeners
+const (
+	readyFD     = 3
+	firstListen = 4
+)
+
+// filer is a listener whose socket can be passed to another process
+type filer interface {
+	File() (*os.File, error)
+}
+
+// handoff keeps the listeners that are passed on upgrades
+var handoff = struct {
+	sync.Mutex
+	open map[string]filer
+}{open: make(map[string]filer)}
+
+// inheritedFile returns the file of the named listener, if it was
+// inherited from the previous process
+func inheritedFile(name string) *os.File {
+	names := os.Getenv(UpgradeEnv)
+	if names == "" {
+		return nil
+	}
+	for i, n := range strings.Split(names, ",") {
+		if n == name {
+			return os.NewFile(uintptr(firstListen+i), name)
+		}
+	}
+	return nil
+}
+
+// listenTCP listens on the address, or takes over the listener from the
+// previous process
+func listenTCP(name, addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if f := inheritedFile(name); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	handoff.Lock()
+	handoff.open[name] = ln.(*net.TCPListener)
+	handoff.Unlock()
+	return ln, nil
+}
+
+// listenUDP is like listenTCP, for UDP sockets
+func listenUDP(name, addr string) (net.PacketConn, error) {
+	var pc net.PacketConn
+	var err error
+	if f := inheritedFile(name); f != nil {
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		pc, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	handoff.Lock()
+	handoff.open[name] = pc.(*net.UDPConn)
+	handoff.Unlock()
+	return pc, nil
+}
+
+// upgradeReady tells the previous process, if any, that this one is
+// ready to take over
+func upgradeReady() {
+	if os.Getenv(UpgradeEnv) == "" {
+		return
+	}
+	ready := os.NewFile(readyFD, "ready")
+	defer ready.Close()
+	if _, err := ready.Write([]byte{1}); err != nil {
+		log.Print("Error telling the previous process we are ready: ", err)
+	}
+}
+
+// upgrade starts the binary again, maybe a new version, with the same
+// arguments, passing it the listeners. It returns once the new process
+// is ready, or kills it if it fails to become ready. The store is kept
+// until this process stops serving.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	handoff.Lock()
+	names := make([]string, 0, len(handoff.open))
+	for name := range handoff.open {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	r, w, err := os.Pipe()
+	if err != nil {
+		handoff.Unlock()
+		return err
+	}
+	defer r.Close()
+	files := []*os.File{w}
+	for _, name := range names {
+		f, err := handoff.open[name].File()
+		if err != nil {
+			handoff.Unlock()
+			return fmt.Errorf("Error passing listener %s: %v", name, err)
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+	handoff.Unlock()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), UpgradeEnv+"="+strings.Join(names, ","))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	log.Printf("Started new process %d, waiting until it is ready", cmd.Process.Pid)
+	result := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if _, err := r.Read(b); err == io.EOF {
+			result <- errors.New("New process exited before being ready")
+		} else {
+			result <- err
+		}
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(UpgradeTimeout):
+		err = errors.New("New process not ready in time")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	// The new process is not our child to wait for anymore
+	cmd.Process.Release()
+	return nil
+}
+
+// upgradeOnSignal upgrades the gateway on SIGUSR2. Once the new process
+// is ready, this one stops accepting connections and drains.
+func upgradeOnSignal(drain func()) {
+	sigChannel := make(chan os.Signal, 1)
+	signal.Notify(sigChannel, syscall.SIGUSR2)
+	for range sigChannel {
+		log.Print("Upgrading")
+		if err := upgrade(); err != nil {
+			log.Print("Error upgrading, keeping this process: ", err)
+			continue
+		}
+		log.Print("New process ready, draining this one")
+		signal.Stop(sigChannel)
+		drain()
+		return
+	}
+}
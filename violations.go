@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// permissionViolations counts the violations reported by the server,
+// by operation and subject, e.g. "publish orders.new"
+var permissionViolations = expvar.NewMap("permission_violations")
+
+// violationRe extracts the operation and subject of a violation
+var violationRe = regexp.MustCompile(`(?i)permissions violation for (publish|subscription) to "([^"]+)"`)
+
+// parseViolation returns the operation and subject of a permissions
+// violation reported by the server
+func parseViolation(err error) (op, subject string, ok bool) {
+	if err == nil || !errors.Is(err, nats.ErrPermissionViolation) {
+		return "", "", false
+	}
+	m := violationRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return "", "", false
+	}
+	return strings.ToLower(m[1]), m[2], true
+}
+
+// violationTracker dispatches the asynchronous violations reported by
+// the server to the requests publishing to the subject
+type violationTracker struct {
+	mu       sync.Mutex
+	watchers map[string]map[*violationWatch]bool
+}
+
+var violations = &violationTracker{watchers: make(map[string]map[*violationWatch]bool)}
+
+// violationWatch is cancelled when a publish to its subject is denied
+type violationWatch struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// denied returns the violation, if any
+func (w *violationWatch) denied() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// watch starts watching for violations publishing to the subject.
+// NATS operations must use the watch context, and release it when done.
+func (t *violationTracker) watch(ctx context.Context, subject string) *violationWatch {
+	w := &violationWatch{}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.watchers[subject] == nil {
+		t.watchers[subject] = make(map[*violationWatch]bool)
+	}
+	t.watchers[subject][w] = true
+	return w
+}
+
+// release stops watching
+func (t *violationTracker) release(subject string, w *violationWatch) {
+	w.cancel()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.watchers[subject], w)
+	if len(t.watchers[subject]) == 0 {
+		delete(t.watchers, subject)
+	}
+}
+
+// handler receives the asynchronous errors of the connection
+func (t *violationTracker) handler(nc *nats.Conn, sub *nats.Subscription, err error) {
+	op, subject, ok := parseViolation(err)
+	if !ok {
+		log.Print("NATS async error: ", err)
+		return
+	}
+	log.Printf("NATS permissions violation: %s to %s", op, subject)
+	permissionViolations.Add(op+" "+subject, 1)
+	if op != "publish" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for w := range t.watchers[subject] {
+		w.mu.Lock()
+		w.err = err
+		w.mu.Unlock()
+		w.cancel()
+	}
+}
+
+// lastViolation returns the last error of the connection if it changed
+// since last, and is a violation publishing to the subject. The server
+// reports violations before answering a flush, but the error handler is
+// called asynchronously, so this catches them earlier.
+func lastViolation(pub *nats.Conn, last error, subject string) error {
+	err := pub.LastError()
+	if err == last {
+		return nil
+	}
+	if op, s, ok := parseViolation(err); ok && op == "publish" && s == subject {
+		return err
+	}
+	return nil
+}